@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"errors"
 	"strconv"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -49,6 +50,7 @@ type JsonRPCNotification struct {
 	JSONRPC string                 `json:"jsonrpc"`
 	Method  string                 `json:"method"`
 	Params  interface{}            `json:"params,omitempty"`
+	Received time.Time             `json:"-"` // set by the event handlers
 }
 
 func (err *JsonRPCError) Error() (string) {
@@ -0,0 +1,114 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/OpenSIPS/call-api/pkg/config"
+)
+
+// Identity - the client on behalf of which commands are run
+type Identity struct {
+	Name string
+	methods map[string]bool
+	events map[string]bool
+}
+
+// the identity used when no authentication is configured
+var anonymous = &Identity{}
+
+// Allowed - checks the policy of the identity for a given command
+func (id *Identity) Allowed(method string) (bool) {
+	if len(id.methods) == 0 {
+		return true
+	}
+	return id.methods[method]
+}
+
+// AllowedEvent - checks the policy of the identity for streaming a raw
+// event; without an explicit list, only the identities that may run any
+// command can stream any event
+func (id *Identity) AllowedEvent(name string) (bool) {
+	if len(id.events) == 0 {
+		return len(id.methods) == 0
+	}
+	return id.events[name]
+}
+
+// Owns - checks whether commands started by owner are visible to the identity
+func (id *Identity) Owns(owner string) (bool) {
+	return id.Name == "" || id.Name == owner
+}
+
+type Authenticator struct {
+	tokens map[string]*Identity
+}
+
+func NewAuthenticator(cfg *config.Config) (*Authenticator) {
+	a := &Authenticator{tokens: make(map[string]*Identity)}
+
+	for _, t := range cfg.Auth.Tokens {
+		id := &Identity{
+			Name: t.Identity,
+			methods: make(map[string]bool),
+			events: make(map[string]bool),
+		}
+		if id.Name == "" {
+			id.Name = t.Token
+		}
+		for _, m := range t.Methods {
+			id.methods[m] = true
+		}
+		for _, e := range t.Events {
+			id.events[e] = true
+		}
+		a.tokens[t.Token] = id
+	}
+	return a
+}
+
+func (a *Authenticator) Enabled() (bool) {
+	return len(a.tokens) != 0
+}
+
+// Authenticate - resolves the identity of an HTTP request, either from a
+// bearer token, or from the "token" query parameter (for browsers, that
+// cannot set headers on WebSocket connections)
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if !a.Enabled() {
+		return anonymous, nil
+	}
+
+	token := r.URL.Query().Get("token")
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimSpace(header[len("Bearer "):])
+	}
+	if token == "" {
+		return nil, errors.New("missing authentication token")
+	}
+
+	id, ok := a.tokens[token]
+	if !ok {
+		return nil, errors.New("invalid authentication token")
+	}
+	return id, nil
+}
@@ -0,0 +1,443 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/OpenSIPS/call-api/pkg/event"
+	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+)
+
+const conference_room_placeholder string = "{room}"
+
+type confParticipant struct {
+	name, callid string
+	sub event.Subscription
+}
+
+// conference - a media server room, owned by the CallConference command
+// that created it
+type conference struct {
+	cmd *Cmd
+	room, uri, callid string
+	lock sync.Mutex
+	pending int /* participants still joining */
+	joined, ended bool
+	participants map[string]*confParticipant
+	leg string /* the leg of the initial call being moved */
+	transferring bool
+	moved int
+	sub event.Subscription
+}
+
+var conferencesLock sync.Mutex
+var conferences = make(map[string]*conference)
+
+func getConference(room string) (*conference) {
+	conferencesLock.Lock()
+	defer conferencesLock.Unlock()
+	return conferences[room]
+}
+
+/* must be called with the conference locked */
+func (cf *conference) checkEnd() {
+	if cf.ended || cf.pending != 0 || len(cf.participants) != 0 {
+		return
+	}
+	cf.ended = true
+
+	conferencesLock.Lock()
+	delete(conferences, cf.room)
+	conferencesLock.Unlock()
+
+	if !cf.joined {
+		cf.cmd.NotifyNewError("no participant joined conference room " + cf.room)
+		return
+	}
+	cf.cmd.NotifyEvent("ConferenceEnded", map[string]interface{}{
+		"room": cf.room,
+	})
+	cf.cmd.NotifyEnd()
+}
+
+func (cf *conference) join(name, callid string) {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+
+	p := &confParticipant{
+		name: name,
+		callid: callid,
+	}
+	var dlgFilter = map[string]interface{}{
+		"callid": callid,
+	}
+	p.sub = cf.cmd.proxy.SubscribeFilter("E_DLG_STATE_CHANGED",
+		func(sub event.Subscription, notify *jsonrpc.JsonRPCNotification) {
+			state, err := notify.Get("new_state")
+			if err == nil && fmt.Sprint(state) == dlg_state_deleted {
+				cf.leave(p)
+			}
+		}, dlgFilter)
+	if p.sub == nil {
+		/* we will not know when it leaves, so do not keep it in the room */
+		cf.pending--
+		cf.cmd.NotifyEvent("ParticipantFailed", map[string]interface{}{
+			"room": cf.room,
+			"participant": name,
+			"reason": "Could not subscribe for event",
+		})
+		cf.checkEnd()
+		return
+	}
+
+	cf.pending--
+	cf.joined = true
+	cf.participants[callid] = p
+	cf.cmd.NotifyEvent("ParticipantJoined", map[string]interface{}{
+		"room": cf.room,
+		"participant": name,
+		"callid": callid,
+	})
+}
+
+func (cf *conference) failed(name, reason string) {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+
+	cf.pending--
+	cf.cmd.NotifyEvent("ParticipantFailed", map[string]interface{}{
+		"room": cf.room,
+		"participant": name,
+		"reason": reason,
+	})
+	cf.checkEnd()
+}
+
+func (cf *conference) leave(p *confParticipant) {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+
+	if cf.participants[p.callid] != p {
+		return
+	}
+	delete(cf.participants, p.callid)
+	p.sub.Unsubscribe()
+	cf.cmd.NotifyEvent("ParticipantLeft", map[string]interface{}{
+		"room": cf.room,
+		"participant": p.name,
+		"callid": p.callid,
+	})
+	cf.checkEnd()
+}
+
+/* looks up a participant either by its name, or by its callid */
+func (cf *conference) find(participant string) (*confParticipant) {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+
+	if p, ok := cf.participants[participant]; ok {
+		return p
+	}
+	for _, p := range cf.participants {
+		if p.name == participant {
+			return p
+		}
+	}
+	return nil
+}
+
+func (cf *conference) list() ([]*confParticipant) {
+	cf.lock.Lock()
+	defer cf.lock.Unlock()
+
+	var list []*confParticipant
+	for _, p := range cf.participants {
+		list = append(list, p)
+	}
+	return list
+}
+
+/* the legs of the initial call are moved one after the other */
+func (cf *conference) transferLeg(leg string) {
+	cf.lock.Lock()
+	cf.leg = leg
+	cf.transferring = true
+	cf.lock.Unlock()
+
+	var transferParams = map[string]string{
+		"callid": cf.callid,
+		"leg": leg,
+		"destination": cf.uri,
+	}
+	err := cf.cmd.proxy.MICall("call_transfer", &transferParams, cf.transferReply)
+	if err != nil {
+		cf.transferDone(err.Error())
+	}
+}
+
+func (cf *conference) transferDone(reason string) {
+	/* both the MI reply and the event may report a failure */
+	cf.lock.Lock()
+	leg := cf.leg
+	if !cf.transferring {
+		cf.lock.Unlock()
+		return
+	}
+	cf.transferring = false
+	if reason == "" {
+		cf.moved++
+	}
+	moved := cf.moved
+	cf.lock.Unlock()
+
+	if reason != "" {
+		cf.failed(leg, reason)
+	}
+
+	if leg == "caller" {
+		/* moving the caller might have released the initial call, and the
+		 * callee along with it - it can only be moved if still there */
+		if _, err := findDialog(cf.cmd, "dlg_list", cf.callid); err == nil {
+			cf.transferLeg("callee")
+			return
+		}
+		cf.failed("callee", "call ended before moving the callee")
+	}
+	cf.sub.Unsubscribe()
+	if moved != 0 {
+		/* the initial call is no longer needed */
+		var byeParams = map[string]string{
+			"dialog_id": cf.callid,
+		}
+		cf.cmd.proxy.MICall("dlg_end_dlg", &byeParams, nil)
+	}
+}
+
+func (cf *conference) transferReply(response *jsonrpc.JsonRPCResponse) {
+
+	if response.IsError() {
+		cf.transferDone(response.Error.Error())
+	}
+}
+
+func (cf *conference) transferNotify(sub event.Subscription, notify *jsonrpc.JsonRPCNotification) {
+
+	state, err := notify.GetString("state")
+	if err != nil {
+		cf.transferDone(err.Error())
+		return
+	}
+	cf.lock.Lock()
+	leg := cf.leg
+	cf.lock.Unlock()
+
+	switch state {
+	case "failure":
+		status, _ := notify.GetString("status")
+		cf.transferDone("transfer failed with status " + status)
+	case "ok":
+		callid, err := notify.GetString("transfer_callid")
+		if err != nil {
+			cf.transferDone(err.Error())
+			return
+		}
+		cf.join(leg, callid)
+		cf.transferDone("")
+	case "start":
+		cf.cmd.NotifyEvent("ParticipantJoining", map[string]interface{}{
+			"room": cf.room,
+			"participant": leg,
+		})
+	}
+}
+
+/* the new participant is called and bridged into the room, just like
+ * CallStart does */
+func (cf *conference) invite(participant string) {
+
+	cs := New("CallStart", "", cf.cmd.proxy)
+	err := cs.Run(map[string]interface{}{
+		"caller": participant,
+		"callee": cf.uri,
+	})
+	if err != nil {
+		cf.failed(participant, err.Error())
+		return
+	}
+	cf.cmd.NotifyEvent("ParticipantJoining", map[string]interface{}{
+		"room": cf.room,
+		"participant": participant,
+	})
+
+	done := false
+	for ev := range cs.Wait() {
+		if done {
+			continue
+		}
+		if ev.IsError() {
+			done = true
+			cf.failed(participant, ev.Error.Error())
+		} else if ev.Name == "CalleeAnswered" {
+			done = true
+			body, _ := ev.Params.(map[string]interface{})
+			callid, _ := body["callid"].(string)
+			cf.join(participant, callid)
+		}
+	}
+	if !done {
+		cf.failed(participant, "call ended before joining")
+	}
+}
+
+func (c *Cmd) CallConference(params map[string]interface{}) {
+
+	callid, ok := params["callid"].(string)
+	if !ok {
+		c.NotifyNewError("callid not specified")
+		return
+	}
+	participant, ok := params["participant"].(string)
+	if !ok {
+		c.NotifyNewError("participant not specified")
+		return
+	}
+	room, ok := params["room"].(string)
+	if !ok {
+		room = c.ID
+	}
+
+	uri := c.proxy.GetConfig().Media.Conference
+	if uri == "" {
+		c.NotifyNewError("conference URI not configured")
+		return
+	}
+	uri = strings.Replace(uri, conference_room_placeholder, room, -1)
+
+	cf := &conference{
+		cmd: c,
+		room: room,
+		uri: uri,
+		callid: callid,
+		pending: 3,
+		participants: make(map[string]*confParticipant),
+	}
+
+	conferencesLock.Lock()
+	if _, ok := conferences[room]; ok {
+		conferencesLock.Unlock()
+		c.NotifyNewError("conference room " + room + " already exists")
+		return
+	}
+	conferences[room] = cf
+	conferencesLock.Unlock()
+
+	var transferFilter = map[string]interface{}{
+		"callid": callid,
+	}
+	cf.sub = c.proxy.SubscribeFilter("E_CALL_TRANSFER", cf.transferNotify, transferFilter)
+	if cf.sub == nil {
+		conferencesLock.Lock()
+		delete(conferences, room)
+		conferencesLock.Unlock()
+		c.NotifyNewError("Could not subscribe for event")
+		return
+	}
+
+	c.NotifyEvent("ConferenceCreated", map[string]interface{}{
+		"room": room,
+		"uri": uri,
+	})
+	cf.transferLeg("caller")
+	go cf.invite(participant)
+}
+
+func endParticipant(c *Cmd, p *confParticipant) (error) {
+	var endParams = map[string]string{
+		"dialog_id": p.callid,
+	}
+	ret, err := c.proxy.MICallSync("dlg_end_dlg", &endParams)
+	if err != nil {
+		return err
+	}
+	if ret.IsError() {
+		return ret.Error
+	}
+	return nil
+}
+
+func (c *Cmd) CallConferenceKick(params map[string]interface{}) {
+
+	room, ok := params["room"].(string)
+	if !ok {
+		c.NotifyNewError("room not specified")
+		return
+	}
+	participant, ok := params["participant"].(string)
+	if !ok {
+		c.NotifyNewError("participant not specified")
+		return
+	}
+
+	cf := getConference(room)
+	if cf == nil || !c.owns(cf.cmd) {
+		c.NotifyNewError("unknown conference room " + room)
+		return
+	}
+	p := cf.find(participant)
+	if p == nil {
+		c.NotifyNewError("unknown participant " + participant)
+		return
+	}
+
+	if err := endParticipant(c, p); err != nil {
+		c.NotifyError(err)
+		return
+	}
+	c.NotifyEnd()
+}
+
+func (c *Cmd) CallConferenceEnd(params map[string]interface{}) {
+
+	room, ok := params["room"].(string)
+	if !ok {
+		c.NotifyNewError("room not specified")
+		return
+	}
+
+	cf := getConference(room)
+	if cf == nil || !c.owns(cf.cmd) {
+		c.NotifyNewError("unknown conference room " + room)
+		return
+	}
+
+	var failed []string
+	for _, p := range cf.list() {
+		if err := endParticipant(c, p); err != nil {
+			failed = append(failed, p.name + ": " + err.Error())
+		}
+	}
+	if len(failed) != 0 {
+		c.NotifyError(errors.New("could not end participants: " + strings.Join(failed, ", ")))
+		return
+	}
+	c.NotifyEnd()
+}
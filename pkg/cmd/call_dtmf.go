@@ -0,0 +1,170 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const default_dtmf_method string = "rfc2833"
+const default_dtmf_duration int = 250
+const default_dtmf_interval int = 100
+
+const dtmf_digits = "0123456789*#ABCD"
+
+type callSendDTMFCmd struct {
+	cmd *Cmd
+	callid, leg, method string
+	duration, interval int
+}
+
+/* RFC 2833/4733 events, injected by the media relay */
+func (cd *callSendDTMFCmd) sendRFC2833(digit string) (error) {
+	var dtmfParams = map[string]string{
+		"callid": cd.callid,
+		"leg": cd.leg,
+		"digit": digit,
+		"duration": strconv.Itoa(cd.duration),
+	}
+	_, err := cd.cmd.mediaCall("play_dtmf", &dtmfParams)
+	return err
+}
+
+/* SIP INFO requests, sent inside the dialog */
+func (cd *callSendDTMFCmd) sendInfo(digit string) (error) {
+	var infoParams = map[string]string{
+		"callid": cd.callid,
+		"mode": cd.leg,
+		"method": "INFO",
+		"content_type": "application/dtmf-relay",
+		"body": fmt.Sprintf("Signal=%s\r\nDuration=%d\r\n", digit, cd.duration),
+	}
+	ret, err := cd.cmd.proxy.MICallSync("dlg_send_sequential", &infoParams)
+	if err != nil {
+		return err
+	}
+	if ret.IsError() {
+		return ret.Error
+	}
+	return nil
+}
+
+func dtmfTiming(params map[string]interface{}, name string, def int) (int, error) {
+	value, ok := params[name].(string)
+	if !ok {
+		return def, nil
+	}
+	ms, err := strconv.Atoi(value)
+	if err != nil || ms < 0 {
+		return 0, fmt.Errorf("invalid %s %s", name, value)
+	}
+	return ms, nil
+}
+
+func (c *Cmd) CallSendDTMF(params map[string]interface{}) {
+	var err error
+
+	callid, ok := params["callid"].(string)
+	if !ok {
+		c.NotifyNewError("callid not specified")
+		return
+	}
+	leg, ok := params["leg"].(string)
+	if !ok {
+		c.NotifyNewError("leg not specified")
+		return
+	}
+	if !validLeg(leg) {
+		c.NotifyNewError("invalid leg " + leg)
+		return
+	}
+	digits, ok := params["digits"].(string)
+	if !ok || digits == "" {
+		c.NotifyNewError("digits not specified")
+		return
+	}
+	digits = strings.ToUpper(digits)
+	for _, d := range digits {
+		if !strings.ContainsRune(dtmf_digits, d) {
+			c.NotifyNewError("invalid DTMF digit " + string(d))
+			return
+		}
+	}
+
+	cfg := c.proxy.GetConfig()
+	cd := &callSendDTMFCmd{
+		cmd: c,
+		callid: callid,
+		leg: leg,
+		method: default_dtmf_method,
+		duration: default_dtmf_duration,
+		interval: default_dtmf_interval,
+	}
+	if cfg.DTMF.Method != "" {
+		cd.method = cfg.DTMF.Method
+	}
+	if cfg.DTMF.Duration != 0 {
+		cd.duration = cfg.DTMF.Duration
+	}
+	if cfg.DTMF.Interval != 0 {
+		cd.interval = cfg.DTMF.Interval
+	}
+	if method, ok := params["method"].(string); ok {
+		cd.method = method
+	}
+
+	var send func(string) (error)
+	switch cd.method {
+	case "rfc2833", "rfc4733":
+		send = cd.sendRFC2833
+	case "info":
+		send = cd.sendInfo
+	default:
+		c.NotifyNewError("invalid DTMF method " + cd.method)
+		return
+	}
+
+	if cd.duration, err = dtmfTiming(params, "duration", cd.duration); err != nil {
+		c.NotifyError(err)
+		return
+	}
+	if cd.interval, err = dtmfTiming(params, "interval", cd.interval); err != nil {
+		c.NotifyError(err)
+		return
+	}
+
+	for i, d := range digits {
+		if i != 0 {
+			time.Sleep(time.Duration(cd.duration + cd.interval) * time.Millisecond)
+		}
+		if err = send(string(d)); err != nil {
+			c.NotifyError(err)
+			return
+		}
+		c.NotifyEvent("DTMFSent", map[string]interface{}{
+			"callid": callid,
+			"leg": leg,
+			"digit": string(d),
+			"method": cd.method,
+		})
+	}
+	c.NotifyEnd()
+}
@@ -18,6 +18,9 @@
 package cmd
 
 import (
+	"errors"
+	"sync"
+
 	"github.com/OpenSIPS/call-api/pkg/event"
 	"github.com/OpenSIPS/call-api/internal/jsonrpc"
 )
@@ -28,27 +31,45 @@ type callHoldCmd struct {
 	callid string
 	caller_done, callee_done bool
 	sub event.Subscription
+	lock sync.Mutex
+	done bool
+}
+
+/* must be called with the command locked; the command's channel is closed
+ * by the error, so nothing can be notified afterwards */
+func (ch *callHoldCmd) fail(err error) {
+	ch.done = true
+	ch.sub.Unsubscribe()
+	ch.cmd.NotifyError(err)
 }
 
 func (ch *callHoldCmd) callHoldNotify(sub event.Subscription, notify *jsonrpc.JsonRPCNotification) {
 
 	var event string
 
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	if ch.done {
+		return
+	}
+
 	state, err := notify.GetString("state")
 	if err != nil {
-		ch.cmd.NotifyError(err)
+		ch.fail(err)
 		return
 	}
 
 	leg, err := notify.GetString("leg")
 	if err != nil {
-		ch.cmd.NotifyError(err)
+		ch.fail(err)
 		return
 	}
 
 	switch state {
 	case "failure":
-		ch.cmd.NotifyNewError("Transfer failed")
+		ch.fail(errors.New("Transfer failed"))
+		return
 	case "ok":
 		if leg == "caller" {
 			ch.caller_done = true
@@ -73,6 +94,7 @@ func (ch *callHoldCmd) callHoldNotify(sub event.Subscription, notify *jsonrpc.Js
 	})
 
 	if state == "ok" && ch.caller_done && ch.callee_done {
+		ch.done = true
 		ch.sub.Unsubscribe()
 		ch.cmd.NotifyEnd()
 	}
@@ -82,9 +104,14 @@ func (ch *callHoldCmd) callHoldReply(response *jsonrpc.JsonRPCResponse) {
 
 	var event string
 
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	if ch.done {
+		return
+	}
 	if response.IsError() {
-		ch.cmd.NotifyError(response.Error)
-		ch.sub.Unsubscribe()
+		ch.fail(response.Error)
 		return
 	}
 
@@ -107,7 +134,15 @@ func (ch *callHoldCmd) callHoldUnhold(cmd string, params map[string]interface{})
 	ch.callid = callid
 
 	/* before transfering, register for new blind transfer events */
-	ch.sub = ch.cmd.proxy.Subscribe("E_CALL_HOLD", ch.callHoldNotify)
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	/* only the events of this call - TransferConsult holds a call while
+	 * taking another one off hold */
+	var callFilter = map[string]interface{}{
+		"callid": callid,
+	}
+	ch.sub = ch.cmd.proxy.SubscribeFilter("E_CALL_HOLD", ch.callHoldNotify, callFilter)
 	if ch.sub == nil {
 		ch.cmd.NotifyNewError("Could not subscribe for event")
 		return
@@ -119,8 +154,7 @@ func (ch *callHoldCmd) callHoldUnhold(cmd string, params map[string]interface{})
 
 	err := ch.cmd.proxy.MICall(cmd, &holdParams, ch.callHoldReply)
 	if err != nil {
-		ch.sub.Unsubscribe()
-		ch.cmd.NotifyError(err)
+		ch.fail(err)
 	}
 }
 
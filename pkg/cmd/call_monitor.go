@@ -0,0 +1,333 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/OpenSIPS/call-api/pkg/config"
+	"github.com/OpenSIPS/call-api/pkg/event"
+	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+)
+
+const monitor_callid_placeholder string = "{callid}"
+
+const (
+	monitor_listen = "listen"
+	monitor_whisper = "whisper"
+	monitor_barge = "barge"
+)
+
+/* the prefix of the events of each mode */
+var monitorEvents = map[string]string{
+	monitor_listen: "Listen",
+	monitor_whisper: "Whisper",
+	monitor_barge: "Barge",
+}
+
+/* the default digits switching the modes, as used by the eavesdrop service
+ * of FreeSWITCH */
+const (
+	default_monitor_listen_digit = "0"
+	default_monitor_whisper_caller_digit = "1"
+	default_monitor_whisper_callee_digit = "2"
+	default_monitor_barge_digit = "3"
+)
+
+/* the DTMF digit that switches the monitoring service to a mode; it is only
+ * sent on the supervisor's call to the service, never on the monitored one */
+func monitorDigit(cfg *config.Config, mode, leg string) (string, error) {
+	digits := cfg.Media.MonitorDigits
+	digit, fallback := digits.Listen, default_monitor_listen_digit
+	switch mode {
+	case monitor_whisper:
+		/* the supervisor whispers to the agent */
+		if leg == "caller" {
+			digit, fallback = digits.WhisperCaller, default_monitor_whisper_caller_digit
+		} else {
+			digit, fallback = digits.WhisperCallee, default_monitor_whisper_callee_digit
+		}
+	case monitor_barge:
+		digit, fallback = digits.Barge, default_monitor_barge_digit
+	}
+	if digit == "" {
+		return fallback, nil
+	}
+	if len(digit) != 1 || !strings.Contains(dtmf_digits, digit) {
+		return "", errors.New("invalid " + mode + " digit " + digit)
+	}
+	return digit, nil
+}
+
+// monitorSession - a supervisor monitoring a call, owned by the command that
+// called the supervisor
+type monitorSession struct {
+	cmd *Cmd
+	callid, leg, supervisor, mode string
+	scallid string /* the supervisor's call to the monitoring service */
+	lock sync.Mutex
+	ended bool
+	callSub, supSub event.Subscription
+}
+
+var monitorsLock sync.Mutex
+var monitors = make(map[string]*monitorSession)
+
+func (ms *monitorSession) release() {
+	monitorsLock.Lock()
+	if monitors[ms.callid] == ms {
+		delete(monitors, ms.callid)
+	}
+	monitorsLock.Unlock()
+}
+
+/* must be called with the session locked */
+func (ms *monitorSession) setMode(mode string) (error) {
+	sd := &callSendDTMFCmd{
+		cmd: ms.cmd,
+		callid: ms.scallid,
+		leg: "callee",
+		duration: default_dtmf_duration,
+	}
+	digit, err := monitorDigit(ms.cmd.proxy.GetConfig(), mode, ms.leg)
+	if err != nil {
+		return err
+	}
+	if err := sd.sendRFC2833(digit); err != nil {
+		return err
+	}
+	ms.mode = mode
+	return nil
+}
+
+func (ms *monitorSession) end(err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if ms.ended {
+		return
+	}
+	ms.ended = true
+	ms.release()
+	if ms.callSub != nil {
+		ms.callSub.Unsubscribe()
+	}
+	if ms.supSub != nil {
+		ms.supSub.Unsubscribe()
+	}
+	if ms.scallid != "" {
+		/* no-op if the supervisor has already hung up */
+		var byeParams = map[string]string{
+			"dialog_id": ms.scallid,
+		}
+		ms.cmd.proxy.MICall("dlg_end_dlg", &byeParams, nil)
+	}
+	if err != nil {
+		ms.cmd.NotifyError(err)
+	} else {
+		ms.cmd.NotifyEnd()
+	}
+}
+
+func (ms *monitorSession) dlgNotify(sub event.Subscription, notify *jsonrpc.JsonRPCNotification) {
+
+	state, err := notify.Get("new_state")
+	if err == nil && fmt.Sprint(state) == dlg_state_deleted {
+		ms.end(nil)
+	}
+}
+
+func (ms *monitorSession) start(mode string) {
+
+	prefix := monitorEvents[mode]
+	uri := strings.Replace(ms.cmd.proxy.GetConfig().Media.Monitor,
+		monitor_callid_placeholder, ms.callid, -1)
+
+	/* the supervisor is called just like CallStart does */
+	cs := New("CallStart", "", ms.cmd.proxy)
+	err := cs.Run(map[string]interface{}{
+		"caller": ms.supervisor,
+		"callee": uri,
+	})
+	if err != nil {
+		ms.end(err)
+		return
+	}
+	ms.cmd.NotifyEvent(prefix + "Start", map[string]interface{}{
+		"callid": ms.callid,
+		"leg": ms.leg,
+		"supervisor": ms.supervisor,
+	})
+
+	scallid := ""
+	for ev := range cs.Wait() {
+		if ev.IsError() {
+			err = ev.Error
+		} else if ev.Name == "CalleeAnswered" {
+			body, _ := ev.Params.(map[string]interface{})
+			scallid, _ = body["callid"].(string)
+		}
+	}
+	if err == nil && scallid == "" {
+		err = errors.New("supervisor call ended before monitoring")
+	}
+	if err != nil {
+		ms.end(err)
+		return
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.scallid = scallid
+	if ms.ended {
+		/* stopped while calling the supervisor */
+		var byeParams = map[string]string{
+			"dialog_id": scallid,
+		}
+		ms.cmd.proxy.MICall("dlg_end_dlg", &byeParams, nil)
+		return
+	}
+
+	var callFilter = map[string]interface{}{
+		"callid": ms.callid,
+	}
+	var supFilter = map[string]interface{}{
+		"callid": ms.scallid,
+	}
+	ms.callSub = ms.cmd.proxy.SubscribeFilter("E_DLG_STATE_CHANGED", ms.dlgNotify, callFilter)
+	ms.supSub = ms.cmd.proxy.SubscribeFilter("E_DLG_STATE_CHANGED", ms.dlgNotify, supFilter)
+	if ms.callSub == nil || ms.supSub == nil {
+		go ms.end(errors.New("Could not subscribe for event"))
+		return
+	}
+
+	/* the service starts in listening mode */
+	ms.mode = monitor_listen
+	if mode != monitor_listen {
+		if err = ms.setMode(mode); err != nil {
+			go ms.end(err)
+			return
+		}
+	}
+	ms.cmd.NotifyEvent(prefix + "Successful", map[string]interface{}{
+		"callid": ms.callid,
+		"leg": ms.leg,
+		"supervisor": ms.supervisor,
+		"mode": mode,
+	})
+}
+
+/* switches the mode of a running session, on behalf of c */
+func (ms *monitorSession) switchMode(c *Cmd, mode string) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if ms.ended {
+		c.NotifyNewError("call " + ms.callid + " is no longer monitored")
+		return
+	}
+	if ms.mode == "" {
+		c.NotifyNewError("monitoring of call " + ms.callid + " is still starting")
+		return
+	}
+	if ms.mode != mode {
+		if err := ms.setMode(mode); err != nil {
+			c.NotifyError(err)
+			return
+		}
+		ms.cmd.NotifyEvent("MonitorModeChanged", map[string]interface{}{
+			"callid": ms.callid,
+			"mode": mode,
+		})
+	}
+	c.NotifyEvent(monitorEvents[mode] + "Successful", map[string]interface{}{
+		"callid": ms.callid,
+		"leg": ms.leg,
+		"supervisor": ms.supervisor,
+		"mode": mode,
+	})
+	c.NotifyEnd()
+}
+
+func (c *Cmd) callMonitor(mode string, params map[string]interface{}) {
+
+	callid, ok := params["callid"].(string)
+	if !ok {
+		c.NotifyNewError("callid not specified")
+		return
+	}
+	leg, ok := params["leg"].(string)
+	if !ok {
+		c.NotifyNewError("leg not specified")
+		return
+	}
+	if !validLeg(leg) {
+		c.NotifyNewError("invalid leg " + leg)
+		return
+	}
+	supervisor, ok := params["supervisor"].(string)
+	if !ok {
+		c.NotifyNewError("supervisor not specified")
+		return
+	}
+	if c.proxy.GetConfig().Media.Monitor == "" {
+		c.NotifyNewError("monitor URI not configured")
+		return
+	}
+
+	monitorsLock.Lock()
+	ms, ok := monitors[callid]
+	if !ok {
+		ms = &monitorSession{
+			cmd: c,
+			callid: callid,
+			leg: leg,
+			supervisor: supervisor,
+		}
+		monitors[callid] = ms
+	}
+	monitorsLock.Unlock()
+
+	if !ok {
+		ms.start(mode)
+		return
+	}
+
+	/* the call is already monitored - only its mode changes */
+	if ms.supervisor != supervisor || ms.leg != leg {
+		c.NotifyNewError("call " + callid + " is already monitored by " + ms.supervisor)
+		return
+	}
+	ms.switchMode(c, mode)
+}
+
+func (c *Cmd) CallListen(params map[string]interface{}) {
+	c.callMonitor(monitor_listen, params)
+}
+
+func (c *Cmd) CallWhisper(params map[string]interface{}) {
+	c.callMonitor(monitor_whisper, params)
+}
+
+func (c *Cmd) CallBarge(params map[string]interface{}) {
+	c.callMonitor(monitor_barge, params)
+}
@@ -0,0 +1,127 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+type callMuteCmd struct {
+	cmd *Cmd
+	mute bool
+	callid, leg, direction string
+}
+
+func (cm *callMuteCmd) callMuteEvent(state string) (string) {
+	if cm.mute {
+		return "CallMute" + state
+	}
+	return "CallUnmute" + state
+}
+
+/* the media flows are identified by the leg that sends them */
+func (cm *callMuteCmd) callMuteFlows() (map[string]string) {
+	switch cm.direction {
+	case "send":
+		return map[string]string{"send": cm.leg}
+	case "recv":
+		return map[string]string{"recv": otherLeg(cm.leg)}
+	default:
+		return map[string]string{
+			"send": cm.leg,
+			"recv": otherLeg(cm.leg),
+		}
+	}
+}
+
+func (cm *callMuteCmd) callMuteUnmute(params map[string]interface{}) {
+	var action string
+
+	callid, ok := params["callid"].(string)
+	if !ok {
+		cm.cmd.NotifyNewError("callid not specified")
+		return
+	}
+	leg, ok := params["leg"].(string)
+	if !ok {
+		cm.cmd.NotifyNewError("leg not specified")
+		return
+	}
+	if !validLeg(leg) {
+		cm.cmd.NotifyNewError("invalid leg " + leg)
+		return
+	}
+	direction, ok := params["direction"].(string)
+	if !ok {
+		direction = "both"
+	}
+	switch direction {
+	case "send", "recv", "both":
+	default:
+		cm.cmd.NotifyNewError("invalid direction " + direction)
+		return
+	}
+	cm.callid = callid
+	cm.leg = leg
+	cm.direction = direction
+
+	if cm.mute {
+		action = "block_media"
+	} else {
+		action = "unblock_media"
+	}
+
+	flows := cm.callMuteFlows()
+	for _, dir := range []string{"send", "recv"} {
+		src, ok := flows[dir]
+		if !ok {
+			continue
+		}
+		body := map[string]interface{}{
+			"leg": leg,
+			"direction": dir,
+		}
+		cm.cmd.NotifyEvent(cm.callMuteEvent("Start"), body)
+
+		var muteParams = map[string]string{
+			"callid": callid,
+			"leg": src,
+		}
+		_, err := cm.cmd.mediaCall(action, &muteParams)
+		if err != nil {
+			cm.cmd.NotifyError(err)
+			return
+		}
+		cm.cmd.NotifyEvent(cm.callMuteEvent("Successful"), body)
+	}
+	cm.cmd.NotifyEnd()
+}
+
+func (c *Cmd) CallMute(params map[string]interface{}) {
+
+	cm := &callMuteCmd{
+		cmd: c,
+		mute: true,
+	}
+	cm.callMuteUnmute(params)
+}
+
+func (c *Cmd) CallUnmute(params map[string]interface{}) {
+
+	cm := &callMuteCmd{
+		cmd: c,
+		mute: false,
+	}
+	cm.callMuteUnmute(params)
+}
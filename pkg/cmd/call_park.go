@@ -0,0 +1,421 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenSIPS/call-api/pkg/event"
+	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+)
+
+const park_slot_placeholder string = "{slot}"
+const default_park_slots int = 100
+const default_park_timeout int = 120
+
+const (
+	park_parking = iota
+	park_parked
+	park_retrieving
+	park_done
+)
+
+// parkedCall - a call parked on a slot, owned by the CallPark command that
+// parked it
+type parkedCall struct {
+	cmd *Cmd
+	slot, callid, leg, parker string
+	pcallid string /* the call of the parked party to the park URI */
+	timeout time.Duration
+	lock sync.Mutex
+	state int
+	timer *time.Timer
+	sub, dlgSub event.Subscription
+}
+
+var parkLock sync.Mutex
+var parkSlots = make(map[string]*parkedCall)
+
+func getParkedCall(slot string) (*parkedCall) {
+	parkLock.Lock()
+	defer parkLock.Unlock()
+	return parkSlots[slot]
+}
+
+/* reserves either the requested slot, or the first free one */
+func reserveParkSlot(pk *parkedCall, slot string, slots int) (error) {
+	parkLock.Lock()
+	defer parkLock.Unlock()
+
+	if slot != "" {
+		n, err := strconv.Atoi(slot)
+		if err != nil || n < 1 || n > slots {
+			return errors.New("invalid slot " + slot)
+		}
+		if _, ok := parkSlots[slot]; ok {
+			return errors.New("slot " + slot + " already in use")
+		}
+		pk.slot = slot
+		parkSlots[slot] = pk
+		return nil
+	}
+	for n := 1; n <= slots; n++ {
+		slot = strconv.Itoa(n)
+		if _, ok := parkSlots[slot]; !ok {
+			pk.slot = slot
+			parkSlots[slot] = pk
+			return nil
+		}
+	}
+	return errors.New("no parking slot available")
+}
+
+func (pk *parkedCall) release() {
+	parkLock.Lock()
+	if parkSlots[pk.slot] == pk {
+		delete(parkSlots, pk.slot)
+	}
+	parkLock.Unlock()
+}
+
+/* must be called with the parked call locked */
+func (pk *parkedCall) finish(event string, body map[string]interface{}, err error) {
+	pk.state = park_done
+	if pk.timer != nil {
+		pk.timer.Stop()
+	}
+	if pk.dlgSub != nil {
+		pk.dlgSub.Unsubscribe()
+	}
+	pk.release()
+
+	if err != nil {
+		pk.cmd.NotifyError(err)
+		return
+	}
+	body["slot"] = pk.slot
+	pk.cmd.NotifyEvent(event, body)
+	pk.cmd.NotifyEnd()
+}
+
+func (pk *parkedCall) parkFailed(err error) {
+	pk.lock.Lock()
+	defer pk.lock.Unlock()
+
+	if pk.state != park_parking {
+		return
+	}
+	pk.sub.Unsubscribe()
+	pk.finish("", nil, err)
+}
+
+func (pk *parkedCall) parkDlgNotify(sub event.Subscription, notify *jsonrpc.JsonRPCNotification) {
+
+	state, err := notify.Get("new_state")
+	if err != nil || fmt.Sprint(state) != dlg_state_deleted {
+		return
+	}
+
+	pk.lock.Lock()
+	defer pk.lock.Unlock()
+
+	/* when retrieving, the call ends after it was bridged */
+	if pk.state != park_parked {
+		return
+	}
+	pk.finish("ParkAbandoned", map[string]interface{}{
+		"callid": pk.pcallid,
+	}, nil)
+}
+
+func (pk *parkedCall) parked(pcallid string) {
+	pk.lock.Lock()
+	defer pk.lock.Unlock()
+
+	if pk.state != park_parking {
+		return
+	}
+	pk.sub.Unsubscribe()
+	pk.pcallid = pcallid
+
+	/* the parking party is no longer needed */
+	var byeParams = map[string]string{
+		"dialog_id": pk.callid,
+	}
+	pk.cmd.proxy.MICall("dlg_end_dlg", &byeParams, nil)
+
+	var dlgFilter = map[string]interface{}{
+		"callid": pcallid,
+	}
+	pk.dlgSub = pk.cmd.proxy.SubscribeFilter("E_DLG_STATE_CHANGED", pk.parkDlgNotify, dlgFilter)
+	if pk.dlgSub == nil {
+		pk.finish("", nil, errors.New("Could not subscribe for event"))
+		return
+	}
+
+	pk.state = park_parked
+	pk.timer = time.AfterFunc(pk.timeout, pk.ringBack)
+	pk.cmd.NotifyEvent("CallParked", map[string]interface{}{
+		"slot": pk.slot,
+		"callid": pcallid,
+		"parker": pk.parker,
+	})
+}
+
+func (pk *parkedCall) parkNotify(sub event.Subscription, notify *jsonrpc.JsonRPCNotification) {
+
+	state, err := notify.GetString("state")
+	if err != nil {
+		pk.parkFailed(err)
+		return
+	}
+
+	switch state {
+	case "failure":
+		status, _ := notify.GetString("status")
+		pk.parkFailed(errors.New("park failed with status " + status))
+	case "ok":
+		callid, err := notify.GetString("transfer_callid")
+		if err != nil {
+			pk.parkFailed(err)
+			return
+		}
+		pk.parked(callid)
+	}
+}
+
+func (pk *parkedCall) parkReply(response *jsonrpc.JsonRPCResponse) {
+
+	if response.IsError() {
+		pk.parkFailed(response.Error)
+		return
+	}
+
+	pk.lock.Lock()
+	defer pk.lock.Unlock()
+	if pk.state != park_parking {
+		return
+	}
+	pk.cmd.NotifyEvent("Parking", map[string]interface{}{
+		"slot": pk.slot,
+	})
+}
+
+/* bridges the parked party to a destination, reporting the progress to c */
+func (pk *parkedCall) bridge(c *Cmd, destination string) (error) {
+	var err error
+
+	bt := New("CallBlindTransfer", "", pk.cmd.proxy)
+	err = bt.Run(map[string]interface{}{
+		"callid": pk.pcallid,
+		"leg": "caller",
+		"destination": destination,
+	})
+	if err != nil {
+		return err
+	}
+	for ev := range bt.Wait() {
+		if ev.IsError() {
+			err = ev.Error
+		} else {
+			c.NotifyEvent(ev.Name, ev.Params)
+		}
+	}
+	return err
+}
+
+/* takes the parked call out of its slot, unless it is already gone */
+func (pk *parkedCall) startRetrieve() (bool) {
+	pk.lock.Lock()
+	defer pk.lock.Unlock()
+
+	if pk.state != park_parked {
+		return false
+	}
+	pk.state = park_retrieving
+	pk.timer.Stop()
+	return true
+}
+
+func (pk *parkedCall) retrieved(destination string, err error) {
+	pk.lock.Lock()
+	defer pk.lock.Unlock()
+
+	if err == nil {
+		pk.finish("ParkRetrieved", map[string]interface{}{
+			"destination": destination,
+		}, nil)
+		return
+	}
+	/* it stays parked, waiting for a new retrieval */
+	pk.state = park_parked
+	pk.timer.Reset(pk.timeout)
+	pk.cmd.NotifyEvent("ParkRetrieveFailed", map[string]interface{}{
+		"slot": pk.slot,
+		"destination": destination,
+		"reason": err.Error(),
+	})
+}
+
+func (pk *parkedCall) ringBack() {
+
+	if !pk.startRetrieve() {
+		return
+	}
+	pk.cmd.NotifyEvent("ParkTimeout", map[string]interface{}{
+		"slot": pk.slot,
+		"parker": pk.parker,
+	})
+
+	err := pk.bridge(pk.cmd, pk.parker)
+
+	pk.lock.Lock()
+	defer pk.lock.Unlock()
+	if err == nil {
+		pk.finish("ParkRetrieved", map[string]interface{}{
+			"destination": pk.parker,
+		}, nil)
+		return
+	}
+
+	/* nobody to get it back, so do not keep it parked forever */
+	var byeParams = map[string]string{
+		"dialog_id": pk.pcallid,
+	}
+	pk.cmd.proxy.MICall("dlg_end_dlg", &byeParams, nil)
+	pk.finish("", nil, errors.New("could not ring back " + pk.parker + ": " + err.Error()))
+}
+
+func (c *Cmd) CallPark(params map[string]interface{}) {
+
+	callid, ok := params["callid"].(string)
+	if !ok {
+		c.NotifyNewError("callid not specified")
+		return
+	}
+	leg, ok := params["leg"].(string)
+	if !ok {
+		c.NotifyNewError("leg not specified")
+		return
+	}
+	if !validLeg(leg) {
+		c.NotifyNewError("invalid leg " + leg)
+		return
+	}
+
+	cfg := c.proxy.GetConfig()
+	if cfg.Park.URI == "" {
+		c.NotifyNewError("park URI not configured")
+		return
+	}
+	slots := default_park_slots
+	if cfg.Park.Slots != 0 {
+		slots = cfg.Park.Slots
+	}
+	timeout := default_park_timeout
+	if cfg.Park.Timeout != 0 {
+		timeout = cfg.Park.Timeout
+	}
+	if value, ok := params["timeout"].(string); ok {
+		t, err := strconv.Atoi(value)
+		if err != nil || t <= 0 {
+			c.NotifyNewError("invalid timeout " + value)
+			return
+		}
+		timeout = t
+	}
+
+	pk := &parkedCall{
+		cmd: c,
+		callid: callid,
+		leg: leg,
+		timeout: time.Duration(timeout) * time.Second,
+		state: park_parking,
+	}
+
+	/* the party parking the call is the one rung back */
+	parker, ok := params["parker"].(string)
+	if !ok {
+		var err error
+		parker, err = dialogParty(c, callid, otherLeg(leg))
+		if err != nil {
+			c.NotifyError(err)
+			return
+		}
+	}
+	pk.parker = parker
+
+	slot, _ := params["slot"].(string)
+	if err := reserveParkSlot(pk, slot, slots); err != nil {
+		c.NotifyError(err)
+		return
+	}
+
+	var transferFilter = map[string]interface{}{
+		"callid": callid,
+	}
+	pk.sub = c.proxy.SubscribeFilter("E_CALL_TRANSFER", pk.parkNotify, transferFilter)
+	if pk.sub == nil {
+		pk.release()
+		c.NotifyNewError("Could not subscribe for event")
+		return
+	}
+
+	var transferParams = map[string]string{
+		"callid": callid,
+		"leg": leg,
+		"destination": strings.Replace(cfg.Park.URI, park_slot_placeholder, pk.slot, -1),
+	}
+	err := c.proxy.MICall("call_transfer", &transferParams, pk.parkReply)
+	if err != nil {
+		pk.parkFailed(err)
+	}
+}
+
+func (c *Cmd) CallRetrieve(params map[string]interface{}) {
+
+	slot, ok := params["slot"].(string)
+	if !ok {
+		c.NotifyNewError("slot not specified")
+		return
+	}
+	destination, ok := params["destination"].(string)
+	if !ok {
+		c.NotifyNewError("destination not specified")
+		return
+	}
+
+	pk := getParkedCall(slot)
+	if pk == nil || !c.owns(pk.cmd) || !pk.startRetrieve() {
+		c.NotifyNewError("no call parked on slot " + slot)
+		return
+	}
+
+	err := pk.bridge(c, destination)
+	pk.retrieved(destination, err)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+	c.NotifyEnd()
+}
@@ -0,0 +1,159 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+)
+
+const default_pickup_profile string = "pickup_group"
+
+/* the dialogs listed by an MI command, such as dlg_list or profile_list_dlgs */
+func listDialogs(c *Cmd, command string, params interface{}) ([]map[string]interface{}, error) {
+
+	ret, err := c.proxy.MICallSync(command, params)
+	if err != nil {
+		return nil, err
+	}
+	if ret.IsError() {
+		return nil, ret.Error
+	}
+
+	var list []map[string]interface{}
+	result, _ := ret.Result.(map[string]interface{})
+	dialogs, _ := result["Dialogs"].([]interface{})
+	for _, d := range dialogs {
+		if dialog, ok := d.(map[string]interface{}); ok {
+			list = append(list, dialog)
+		}
+	}
+	return list, nil
+}
+
+/* looks for a call ringing at the target, or in the pickup group */
+func (c *Cmd) ringingDialog(target, group string) (map[string]interface{}, error) {
+	var dialogs []map[string]interface{}
+	var err error
+
+	if group != "" {
+		profile := c.proxy.GetConfig().Pickup.Profile
+		if profile == "" {
+			profile = default_pickup_profile
+		}
+		var profileParams = map[string]string{
+			"profile": profile,
+			"value": group,
+		}
+		dialogs, err = listDialogs(c, "profile_list_dlgs", &profileParams)
+	} else {
+		dialogs, err = listDialogs(c, "dlg_list", nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	aor := ""
+	if target != "" {
+		aor = c.locationAOR(target)
+	}
+	for _, dialog := range dialogs {
+		switch fmt.Sprint(dialog["state"]) {
+		case dlg_state_unconfirmed, dlg_state_early:
+		default:
+			continue
+		}
+		if aor != "" {
+			to, _ := dialog["to_uri"].(string)
+			if c.locationAOR(to) != aor {
+				continue
+			}
+		}
+		return dialog, nil
+	}
+	return nil, errors.New("no ringing call found")
+}
+
+func (c *Cmd) CallPickup(params map[string]interface{}) {
+	var err error
+
+	requester, ok := params["requester"].(string)
+	if !ok {
+		c.NotifyNewError("requester not specified")
+		return
+	}
+	target, _ := params["target"].(string)
+	group, _ := params["group"].(string)
+	if target == "" && group == "" {
+		c.NotifyNewError("target not specified")
+		return
+	}
+
+	body := map[string]interface{}{
+		"requester": requester,
+	}
+	failed := func(err error) {
+		body["reason"] = err.Error()
+		c.NotifyEvent("PickupFailed", body)
+		c.NotifyError(err)
+	}
+
+	dialog, err := c.ringingDialog(target, group)
+	if err != nil {
+		failed(err)
+		return
+	}
+	callid, ok := dialog["callid"].(string)
+	if !ok {
+		failed(errors.New("could not find the Call-ID of the ringing call"))
+		return
+	}
+	body["picked_callid"] = callid
+	if to, ok := dialog["to_uri"].(string); ok {
+		body["target"] = to
+	}
+	c.NotifyEvent("PickupStart", body)
+
+	/* the caller is sent to the requester's device */
+	bt := New("CallBlindTransfer", "", c.proxy)
+	err = bt.Run(map[string]interface{}{
+		"callid": callid,
+		"leg": "caller",
+		"destination": requester,
+	})
+	if err != nil {
+		failed(err)
+		return
+	}
+	newCallid := ""
+	for ev := range bt.Wait() {
+		if ev.IsError() {
+			err = ev.Error
+		} else if ev.Name == "TransferSuccessful" {
+			result, _ := ev.Params.(map[string]interface{})
+			newCallid, _ = result["callid"].(string)
+		}
+	}
+	if err != nil {
+		failed(err)
+		return
+	}
+	body["callid"] = newCallid
+	c.NotifyEvent("PickupSuccessful", body)
+	c.NotifyEnd()
+}
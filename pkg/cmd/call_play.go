@@ -0,0 +1,305 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/OpenSIPS/call-api/pkg/event"
+	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+)
+
+// playback - an audio played by the media relay into the legs of a call,
+// waited for by the command that started it
+type playback struct {
+	cmd *Cmd
+	callid string
+	legs []string
+	lock sync.Mutex
+	done bool
+	timer *time.Timer
+	sub event.Subscription
+}
+
+var playbacksLock sync.Mutex
+var playbacks = make(map[string]*playback) /* by callid */
+
+/* how long the owner of a playback of unknown duration is remembered */
+const play_owner_expire time.Duration = time.Hour
+
+// playOwner - the identity that started the last playback of a call, waited
+// for or not, which is the only one allowed to stop it
+type playOwner struct {
+	identity string
+	expires time.Time
+}
+
+var playOwners = make(map[string]*playOwner) /* by callid, under playbacksLock */
+
+func setPlayOwner(callid, identity string, length time.Duration) {
+	now := time.Now()
+	playbacksLock.Lock()
+	defer playbacksLock.Unlock()
+
+	for id, po := range playOwners {
+		if now.After(po.expires) {
+			delete(playOwners, id)
+		}
+	}
+	playOwners[callid] = &playOwner{identity: identity, expires: now.Add(length)}
+}
+
+/* checks whether c may stop the playbacks of a call */
+func (c *Cmd) ownsPlayback(callid string) (bool) {
+	if c.identity == "" {
+		return true
+	}
+	playbacksLock.Lock()
+	defer playbacksLock.Unlock()
+
+	po, ok := playOwners[callid]
+	return ok && po.identity == c.identity && !time.Now().After(po.expires)
+}
+
+/* the legs a playback is done for - both, if not specified */
+func playLegs(params map[string]interface{}) ([]string, error) {
+	leg, ok := params["leg"].(string)
+	if !ok || leg == "both" {
+		return []string{"caller", "callee"}, nil
+	}
+	if !validLeg(leg) {
+		return nil, errors.New("invalid leg " + leg)
+	}
+	return []string{leg}, nil
+}
+
+/* the duration (in milliseconds) reported by the media relay, if any */
+func playDuration(ret *jsonrpc.JsonRPCResponse) (int, bool) {
+	result, _ := ret.Result.(map[string]interface{})
+	switch d := result["duration"].(type) {
+	case float64:
+		return int(d), d > 0
+	case string:
+		ms, err := strconv.Atoi(d)
+		return ms, err == nil && ms > 0
+	}
+	return 0, false
+}
+
+func (pb *playback) end(reason string) {
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+
+	if pb.done {
+		return
+	}
+	pb.done = true
+	if pb.timer != nil {
+		pb.timer.Stop()
+	}
+	if pb.sub != nil {
+		pb.sub.Unsubscribe()
+	}
+	playbacksLock.Lock()
+	if playbacks[pb.callid] == pb {
+		delete(playbacks, pb.callid)
+	}
+	playbacksLock.Unlock()
+
+	pb.cmd.NotifyEvent("PlaybackEnded", map[string]interface{}{
+		"callid": pb.callid,
+		"legs": pb.legs,
+		"reason": reason,
+	})
+	pb.cmd.NotifyEnd()
+}
+
+func (pb *playback) dlgNotify(sub event.Subscription, notify *jsonrpc.JsonRPCNotification) {
+
+	state, err := notify.Get("new_state")
+	if err == nil && fmt.Sprint(state) == dlg_state_deleted {
+		pb.end("call ended")
+	}
+}
+
+func (c *Cmd) CallPlay(params map[string]interface{}) {
+
+	callid, ok := params["callid"].(string)
+	if !ok {
+		c.NotifyNewError("callid not specified")
+		return
+	}
+	file, ok := params["file"].(string)
+	if !ok {
+		c.NotifyNewError("file not specified")
+		return
+	}
+	legs, err := playLegs(params)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+	repeat := 1
+	if value, ok := params["repeat"].(string); ok {
+		repeat, err = strconv.Atoi(value)
+		if err != nil || repeat <= 0 {
+			c.NotifyNewError("invalid repeat " + value)
+			return
+		}
+	}
+	wait := false
+	if value, ok := params["wait"].(string); ok {
+		wait, err = strconv.ParseBool(value)
+		if err != nil {
+			c.NotifyNewError("invalid wait " + value)
+			return
+		}
+	}
+
+	/* the playback lasts as long as its longest leg */
+	duration := 0
+	known := false
+	for i, leg := range legs {
+		var playParams = map[string]string{
+			"callid": callid,
+			"leg": leg,
+			"file": file,
+			"repeat": strconv.Itoa(repeat),
+		}
+		ret, err := c.mediaCall("play_media", &playParams)
+		if err != nil {
+			/* do not leave the other legs playing */
+			for _, started := range legs[:i] {
+				var stopParams = map[string]string{
+					"callid": callid,
+					"leg": started,
+				}
+				c.mediaCall("stop_media", &stopParams)
+			}
+			c.NotifyError(err)
+			return
+		}
+		if d, ok := playDuration(ret); ok {
+			known = true
+			if d > duration {
+				duration = d
+			}
+		}
+	}
+
+	body := map[string]interface{}{
+		"callid": callid,
+		"legs": legs,
+		"file": file,
+		"repeat": repeat,
+	}
+	length := play_owner_expire
+	if known {
+		body["duration"] = duration * repeat
+		length = time.Duration(duration * repeat) * time.Millisecond
+	}
+	setPlayOwner(callid, c.identity, length)
+	c.NotifyEvent("PlaybackStarted", body)
+	if !wait {
+		c.NotifyEnd()
+		return
+	}
+	if !known {
+		c.NotifyNewError("could not wait for the playback: unknown duration")
+		return
+	}
+
+	pb := &playback{
+		cmd: c,
+		callid: callid,
+		legs: legs,
+	}
+	pb.lock.Lock()
+	defer pb.lock.Unlock()
+
+	/* a new playback replaces the one waited for */
+	playbacksLock.Lock()
+	old := playbacks[callid]
+	playbacks[callid] = pb
+	playbacksLock.Unlock()
+	if old != nil {
+		go old.end("replaced")
+	}
+
+	var callFilter = map[string]interface{}{
+		"callid": callid,
+	}
+	pb.sub = c.proxy.SubscribeFilter("E_DLG_STATE_CHANGED", pb.dlgNotify, callFilter)
+	if pb.sub == nil {
+		pb.done = true
+		playbacksLock.Lock()
+		delete(playbacks, callid)
+		playbacksLock.Unlock()
+		c.NotifyNewError("Could not subscribe for event")
+		return
+	}
+	pb.timer = time.AfterFunc(time.Duration(duration * repeat) * time.Millisecond, func() {
+		pb.end("completed")
+	})
+}
+
+func (c *Cmd) CallStopPlay(params map[string]interface{}) {
+
+	callid, ok := params["callid"].(string)
+	if !ok {
+		c.NotifyNewError("callid not specified")
+		return
+	}
+	legs, err := playLegs(params)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+	if !c.ownsPlayback(callid) {
+		c.NotifyNewError("no playback on call " + callid)
+		return
+	}
+
+	for _, leg := range legs {
+		var stopParams = map[string]string{
+			"callid": callid,
+			"leg": leg,
+		}
+		if _, err := c.mediaCall("stop_media", &stopParams); err != nil {
+			c.NotifyError(err)
+			return
+		}
+	}
+
+	playbacksLock.Lock()
+	pb := playbacks[callid]
+	playbacksLock.Unlock()
+	if pb != nil {
+		pb.end("stopped")
+	}
+
+	c.NotifyEvent("PlaybackStopped", map[string]interface{}{
+		"callid": callid,
+		"legs": legs,
+	})
+	c.NotifyEnd()
+}
@@ -0,0 +1,212 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/OpenSIPS/call-api/pkg/event"
+	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+)
+
+// recording - a recording started through the API, forgotten when stopped
+// or when its call ends
+type recording struct {
+	callid, id string
+	lock sync.Mutex
+	done bool
+	sub event.Subscription
+}
+
+/* the recordings started through the API, indexed by callid */
+var recordings = struct {
+	sync.Mutex
+	ids map[string]*recording
+}{ids: make(map[string]*recording)}
+
+/* drops a recording, unless it was replaced in the meantime */
+func (rec *recording) forget() {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	if rec.done {
+		return
+	}
+	rec.done = true
+	recordings.Lock()
+	if recordings.ids[rec.callid] == rec {
+		delete(recordings.ids, rec.callid)
+	}
+	recordings.Unlock()
+	if rec.sub != nil {
+		rec.sub.Unsubscribe()
+	}
+}
+
+func (rec *recording) dlgNotify(sub event.Subscription, notify *jsonrpc.JsonRPCNotification) {
+
+	state, err := notify.Get("new_state")
+	if err == nil && fmt.Sprint(state) == dlg_state_deleted {
+		rec.forget()
+	}
+}
+
+type callRecordCmd struct {
+	cmd *Cmd
+	action, state, event string
+}
+
+func (cr *callRecordCmd) callRecordMICommand() (string) {
+	recorder := cr.cmd.proxy.MediaRecorder()
+
+	/* rtpengine resumes a paused recording by starting it again */
+	if recorder == "rtpengine" && cr.action == "resume" {
+		return recorder + "_start_recording"
+	}
+	return recorder + "_" + cr.action + "_recording"
+}
+
+func (cr *callRecordCmd) callRecord(params map[string]interface{}) {
+
+	callid, ok := params["callid"].(string)
+	if !ok {
+		cr.cmd.NotifyNewError("callid not specified")
+		return
+	}
+
+	recording_id := ""
+	recordings.Lock()
+	rec, known := recordings.ids[callid]
+	if known {
+		recording_id = rec.id
+	}
+	recordings.Unlock()
+	if id, ok := params["recording_id"].(string); ok {
+		recording_id = id
+	} else if !known {
+		if cr.action != "start" {
+			cr.cmd.NotifyNewError("no recording started for call " + callid)
+			return
+		}
+		recording_id = uuid.New().String()
+	}
+
+	var recordParams = map[string]interface{}{
+		"callid": callid,
+		"recording_id": recording_id,
+	}
+	if metadata, ok := params["metadata"]; ok {
+		metadata, ok := metadata.(map[string]interface{})
+		if !ok {
+			cr.cmd.NotifyNewError("metadata must be an object")
+			return
+		}
+		recordParams["metadata"] = metadata
+	}
+
+	ret, err := cr.cmd.proxy.MICallSync(cr.callRecordMICommand(), &recordParams)
+	if err != nil {
+		cr.cmd.NotifyError(err)
+		return
+	} else if ret.IsError() {
+		cr.cmd.NotifyError(ret.Error)
+		return
+	}
+
+	/* the recorder might have chosen its own id */
+	if id, err := ret.GetString("recording_id"); err == nil && id != "" {
+		recording_id = id
+	}
+
+	if cr.action == "stop" {
+		if known {
+			rec.forget()
+		}
+	} else if !known || rec.id != recording_id {
+		if known {
+			rec.forget()
+		}
+		rec = &recording{callid: callid, id: recording_id}
+		var callFilter = map[string]interface{}{
+			"callid": callid,
+		}
+		/* the recording is forgotten when the call ends, otherwise its id
+		 * would be reused for a later call with the same callid */
+		rec.lock.Lock()
+		rec.sub = cr.cmd.proxy.SubscribeFilter("E_DLG_STATE_CHANGED", rec.dlgNotify, callFilter)
+		if rec.sub != nil {
+			recordings.Lock()
+			recordings.ids[callid] = rec
+			recordings.Unlock()
+		}
+		rec.lock.Unlock()
+	}
+
+	cr.cmd.NotifyEvent(cr.event, map[string]interface{}{
+		"callid": callid,
+		"recording_id": recording_id,
+		"state": cr.state,
+	})
+	cr.cmd.NotifyEnd()
+}
+
+func (c *Cmd) CallRecordStart(params map[string]interface{}) {
+
+	cr := &callRecordCmd{
+		cmd: c,
+		action: "start",
+		state: "recording",
+		event: "RecordingStarted",
+	}
+	cr.callRecord(params)
+}
+
+func (c *Cmd) CallRecordStop(params map[string]interface{}) {
+
+	cr := &callRecordCmd{
+		cmd: c,
+		action: "stop",
+		state: "stopped",
+		event: "RecordingStopped",
+	}
+	cr.callRecord(params)
+}
+
+func (c *Cmd) CallRecordPause(params map[string]interface{}) {
+
+	cr := &callRecordCmd{
+		cmd: c,
+		action: "pause",
+		state: "paused",
+		event: "RecordingPaused",
+	}
+	cr.callRecord(params)
+}
+
+func (c *Cmd) CallRecordResume(params map[string]interface{}) {
+
+	cr := &callRecordCmd{
+		cmd: c,
+		action: "resume",
+		state: "recording",
+		event: "RecordingResumed",
+	}
+	cr.callRecord(params)
+}
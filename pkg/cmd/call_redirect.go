@@ -0,0 +1,118 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+)
+
+const default_redirect_value string = "trans_id"
+
+var redirectReasons = map[string]string{
+	"301": "Moved Permanently",
+	"302": "Moved Temporarily",
+}
+
+type callRedirectCmd struct {
+	cmd *Cmd
+	callid, destination, code string
+}
+
+func (cr *callRedirectCmd) callRedirectReply(response *jsonrpc.JsonRPCResponse) {
+
+	if response.IsError() {
+		cr.cmd.NotifyError(response.Error)
+		return
+	}
+	cr.cmd.NotifyEvent("CallRedirected", map[string]interface{}{
+		"callid": cr.callid,
+		"destination": cr.destination,
+		"code": cr.code,
+	})
+	cr.cmd.NotifyEnd()
+}
+
+func (c *Cmd) CallRedirect(params map[string]interface{}) {
+
+	callid, ok := params["callid"].(string)
+	if !ok {
+		c.NotifyNewError("callid not specified")
+		return
+	}
+	destination, ok := params["destination"].(string)
+	if !ok {
+		c.NotifyNewError("destination not specified")
+		return
+	}
+	code, ok := params["code"].(string)
+	if !ok {
+		code = "302"
+	}
+	reason, ok := redirectReasons[code]
+	if !ok {
+		c.NotifyNewError("invalid code " + code)
+		return
+	}
+
+	dialog, err := findDialog(c, "dlg_list_ctx", callid)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+	switch fmt.Sprint(dialog["state"]) {
+	case dlg_state_unconfirmed, dlg_state_early:
+	default:
+		c.NotifyError(errors.New("call " + callid + " is not ringing"))
+		return
+	}
+
+	/* only the script knows the transaction of the INVITE */
+	name := default_redirect_value
+	if cfg := c.proxy.GetConfig(); cfg.Redirect.TransactionValue != "" {
+		name = cfg.Redirect.TransactionValue
+	}
+	transaction, ok := dialogValue(dialog, name)
+	if !ok {
+		c.NotifyNewError("could not find the transaction of call " + callid)
+		return
+	}
+
+	var replyParams = map[string]string{
+		"code": code,
+		"reason": reason,
+		"trans_id": transaction,
+		"to_tag": strings.Replace(uuid.New().String(), "-", "", -1),
+		"new_headers": "Contact: <" + destination + ">\r\n",
+	}
+	cr := &callRedirectCmd{
+		cmd: c,
+		callid: callid,
+		destination: destination,
+		code: code,
+	}
+	err = c.proxy.MICall("t_reply", &replyParams, cr.callRedirectReply)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+}
@@ -18,13 +18,121 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 	"github.com/OpenSIPS/call-api/pkg/event"
 	"github.com/OpenSIPS/call-api/internal/jsonrpc"
 )
 
+/* parses a boolean parameter, given either as a JSON boolean or as a string */
+func boolParam(v interface{}, name string) (bool, error) {
+	switch b := v.(type) {
+	case bool:
+		return b, nil
+	case string:
+		value, err := strconv.ParseBool(b)
+		if err == nil {
+			return value, nil
+		}
+	}
+	return false, fmt.Errorf("invalid %s %v", name, v)
+}
+
+// TransferError - the callee refused the call, with a SIP status
+type TransferError struct {
+	Status string /* code and reason, as reported by the proxy */
+}
+
+func (e *TransferError) Error() (string) {
+	return "transfer failed with status " + e.Status
+}
+
+// Code - the SIP status code, or 0 if it could not be parsed
+func (e *TransferError) Code() (int) {
+	code, err := strconv.Atoi(strings.SplitN(strings.TrimSpace(e.Status), " ", 2)[0])
+	if err != nil {
+		return 0
+	}
+	return code
+}
+
+const inviteHeadersFormat = "From: <%s>\r\n" +
+	"To: <%s>\r\n" +
+	"Contact: <%s>\r\n" +
+	"Content-Type: application/sdp\r\n" +
+	"CSeq: 1 INVITE\r\n" +
+	"Call-Id: %s\r\n"
+
+const inviteBody = "v=0\r\n" +
+	"o=click-to-dial 0 0 IN IP4 0.0.0.0\r\n" +
+	"s=session\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 9 RTP/AVP 0\r\n" +
+	"a=rtpmap:0 PCMU/8000\r\n"
+
+/* builds an INVITE without media, sent to ruri, to be bridged later */
+func (c *Cmd) inviteParams(ruri, from, to, callid string) (*map[string]string) {
+
+	var inviteParams = map[string]string{
+		"method": "INVITE",
+		"ruri": ruri,
+		"headers": fmt.Sprintf(inviteHeadersFormat, from, to, from, callid),
+		"body": inviteBody,
+	}
+	var next_hop = c.proxy.GetURI()
+	if next_hop != "" {
+		inviteParams["next_hop"] = next_hop
+	}
+	return &inviteParams
+}
+
+/* builds a BYE for a dialog started with inviteParams */
+func byeParams(ruri, dlginfo string) (*map[string]string) {
+	return &map[string]string{
+		"method": "BYE",
+		"ruri": ruri,
+		"headers": dlginfo + "CSeq: 3 BYE\r\n", /* guessing the cseq */
+	}
+}
+
+/* checks the INVITE was answered, and gathers information about the dialog,
+ * so we can close it later */
+func answeredDialog(response *jsonrpc.JsonRPCResponse) (string, string, error) {
+
+	var dlginfo string
+
+	status, err := response.GetString("Status")
+	if err != nil {
+		return "", "", err
+	}
+
+	if strings.Split(status, " ")[0] != "200" {
+		return "", "", errors.New("failed to establish initial call: " + status)
+	}
+
+	ruri, err := response.GetString("RURI")
+	if err != nil {
+		return "", "", err
+	}
+
+	message, err := response.GetString("Message");
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, header := range strings.Split(message, "\r\n") {
+		switch strings.Split(header, ":")[0] {
+		case "From", "To", "Routes", "Call-ID", "Call-Id":
+			dlginfo += header + "\r\n"
+		}
+	}
+	return ruri, dlginfo, nil
+}
+
 type callStartCmd struct {
 	caller, callee, ruri, dlginfo string
 	sub event.Subscription
@@ -32,13 +140,8 @@ type callStartCmd struct {
 }
 
 func (cs *callStartCmd) callStartEnd() {
-	var byeParams = map[string]string{
-		"method": "BYE",
-		"ruri": cs.ruri,
-		"headers": cs.dlginfo + "CSeq: 3 BYE\r\n", /* guessing the cseq */
-	}
 	cs.sub.Unsubscribe()
-	cs.cmd.proxy.MICall("t_uac_dlg", &byeParams, nil)
+	cs.cmd.proxy.MICall("t_uac_dlg", byeParams(cs.ruri, cs.dlginfo), nil)
 }
 
 
@@ -66,7 +169,7 @@ func (cs *callStartCmd) callStartNotify(sub event.Subscription, notify *jsonrpc.
 
 	switch state {
 	case "failure":
-		cs.cmd.NotifyNewError("transfer failed with status " + status)
+		cs.cmd.NotifyError(&TransferError{Status: status})
 		return
 	case "ok":
 		event = "CalleeAnswered"
@@ -111,42 +214,19 @@ func (cs *callStartCmd) callStartTransfer(response *jsonrpc.JsonRPCResponse) {
 
 func (cs *callStartCmd) callStartInitial(response *jsonrpc.JsonRPCResponse) {
 
+	var err error
+
 	if response.IsError() {
 		cs.cmd.NotifyError(response.Error)
 		return
 	}
 
-	status, err := response.GetString("Status")
-	if err != nil {
-		cs.cmd.NotifyError(err)
-		return
-	}
-
-	if strings.Split(status, " ")[0] != "200" {
-		cs.cmd.NotifyNewError("failed to establish initial call: " + status)
-		return
-	}
-
-	cs.ruri, err = response.GetString("RURI")
-	if err != nil {
-		cs.cmd.NotifyError(err)
-		return
-	}
-
-	message, err := response.GetString("Message");
+	cs.ruri, cs.dlginfo, err = answeredDialog(response)
 	if err != nil {
 		cs.cmd.NotifyError(err)
 		return
 	}
 
-	/* gather information about the dialog, so we can close it later */
-	for _, header := range strings.Split(message, "\r\n") {
-		switch strings.Split(header, ":")[0] {
-		case "From", "To", "Routes", "Call-ID", "Call-Id":
-			cs.dlginfo += header + "\r\n"
-		}
-	}
-
 	cs.cmd.NotifyEvent("CallerAnswered", map[string]interface{}{
 		"caller": cs.caller,
 		"callee": cs.callee,
@@ -180,21 +260,6 @@ func (cs *callStartCmd) callStartInitial(response *jsonrpc.JsonRPCResponse) {
 
 func (c *Cmd) CallStart(params map[string]interface{}) {
 
-	const headersFormat = "From: <%s>\r\n" +
-		"To: <%s>\r\n" +
-		"Contact: <%s>\r\n" +
-		"Content-Type: application/sdp\r\n" +
-		"CSeq: 1 INVITE\r\n" +
-		"Call-Id: %s\r\n"
-
-	const inviteBody = "v=0\r\n" +
-		"o=click-to-dial 0 0 IN IP4 0.0.0.0\r\n" +
-		"s=session\r\n" +
-		"c=IN IP4 0.0.0.0\r\n" +
-		"t=0 0\r\n" +
-		"m=audio 9 RTP/AVP 0\r\n" +
-		"a=rtpmap:0 PCMU/8000\r\n"
-
 	caller, ok := params["caller"].(string)
 	if !ok {
 		c.NotifyNewError("caller not specified")
@@ -206,17 +271,28 @@ func (c *Cmd) CallStart(params map[string]interface{}) {
 		return
 	}
 
-	headers := fmt.Sprintf(headersFormat, caller, callee, caller, c.ID)
-
-	var inviteParams = map[string]string{
-		"method": "INVITE",
-		"ruri": caller,
-		"headers": headers,
-		"body": inviteBody,
+	check := false
+	if value, ok := params["check_registered"]; ok {
+		var err error
+		if check, err = boolParam(value, "check_registered"); err != nil {
+			c.NotifyError(err)
+			return
+		}
 	}
-	var next_hop = c.proxy.GetURI()
-	if next_hop != "" {
-		inviteParams["next_hop"] = next_hop
+	/* fail fast if the caller cannot be reached */
+	if check {
+		contacts, err := c.lookupContacts(c.locationAOR(caller))
+		if err != nil {
+			c.NotifyError(err)
+			return
+		}
+		if len(contacts) == 0 {
+			c.NotifyEvent("CallerNotRegistered", map[string]interface{}{
+				"caller": caller,
+			})
+			c.NotifyNewError("caller not registered")
+			return
+		}
 	}
 
 	cs := &callStartCmd{
@@ -227,7 +303,7 @@ func (c *Cmd) CallStart(params map[string]interface{}) {
 		cmd: c,
 	}
 
-	err := c.proxy.MICall("t_uac_dlg", &inviteParams, cs.callStartInitial)
+	err := c.proxy.MICall("t_uac_dlg", c.inviteParams(caller, caller, callee, c.ID), cs.callStartInitial)
 	if err != nil {
 		c.NotifyError(err)
 		return
@@ -0,0 +1,407 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/OpenSIPS/call-api/pkg/event"
+	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+)
+
+const (
+	group_simultaneous = "simultaneous"
+	group_sequential = "sequential"
+	group_weighted = "weighted"
+)
+
+const default_group_timeout int = 30
+
+type groupTarget struct {
+	uri, callid string
+	weight float64
+	ruri, dlginfo string
+	ringing bool
+	timer *time.Timer
+}
+
+type callStartGroupCmd struct {
+	cmd *Cmd
+	caller, ruri, dlginfo string
+	strategy string
+	timeout time.Duration
+	targets []*groupTarget
+	next int /* the next target to ring */
+	lock sync.Mutex
+	winner *groupTarget
+	done bool
+	sub event.Subscription
+}
+
+/* parses the callees, either as URIs, or as {"uri", "weight"} objects */
+func groupTargets(id string, callees []interface{}) ([]*groupTarget, error) {
+	var targets []*groupTarget
+
+	for i, callee := range callees {
+		t := &groupTarget{
+			callid: fmt.Sprintf("%s-%d", id, i + 1),
+			weight: 1,
+		}
+		switch v := callee.(type) {
+		case string:
+			t.uri = v
+		case map[string]interface{}:
+			uri, ok := v["uri"].(string)
+			if !ok {
+				return nil, errors.New("callee uri not specified")
+			}
+			t.uri = uri
+			switch w := v["weight"].(type) {
+			case nil:
+			case float64:
+				t.weight = w
+			case string:
+				weight, err := strconv.ParseFloat(w, 64)
+				if err != nil {
+					return nil, errors.New("invalid weight " + w)
+				}
+				t.weight = weight
+			default:
+				return nil, errors.New("invalid weight for " + uri)
+			}
+			if t.weight <= 0 {
+				return nil, errors.New("invalid weight for " + uri)
+			}
+		default:
+			return nil, errors.New("invalid callee")
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+/* orders the targets randomly, the heavier ones being more likely first */
+func weightedOrder(targets []*groupTarget) ([]*groupTarget) {
+	var ordered []*groupTarget
+
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	left := append([]*groupTarget(nil), targets...)
+	for len(left) != 0 {
+		total := 0.0
+		for _, t := range left {
+			total += t.weight
+		}
+		pick := r.Float64() * total
+		i := 0
+		for ; i < len(left) - 1; i++ {
+			pick -= left[i].weight
+			if pick < 0 {
+				break
+			}
+		}
+		ordered = append(ordered, left[i])
+		left = append(left[:i], left[i+1:]...)
+	}
+	return ordered
+}
+
+/* must be called with the command locked */
+func (cg *callStartGroupCmd) fail(err error) {
+	if cg.done {
+		return
+	}
+	cg.done = true
+	if cg.sub != nil {
+		cg.sub.Unsubscribe()
+	}
+	cg.cmd.proxy.MICall("t_uac_dlg", byeParams(cg.ruri, cg.dlginfo), nil)
+	cg.cmd.NotifyError(err)
+}
+
+/* must be called with the command locked */
+func (cg *callStartGroupCmd) cancel(t *groupTarget) {
+	var cancelParams = map[string]string{
+		"callid": t.callid,
+		"cseq": "1",
+	}
+	cg.cmd.proxy.MICall("t_uac_cancel", &cancelParams, nil)
+}
+
+/* must be called with the command locked */
+func (cg *callStartGroupCmd) ring(t *groupTarget) {
+
+	t.ringing = true
+	reply := func(response *jsonrpc.JsonRPCResponse) {
+		cg.targetReply(t, response)
+	}
+	err := cg.cmd.proxy.MICall("t_uac_dlg", cg.cmd.inviteParams(t.uri, cg.caller, t.uri, t.callid), reply)
+	if err != nil {
+		t.ringing = false
+		cg.cmd.NotifyEvent("TargetFailed", map[string]interface{}{
+			"target": t.uri,
+			"reason": err.Error(),
+		})
+		return
+	}
+	cg.cmd.NotifyEvent("TargetRinging", map[string]interface{}{
+		"target": t.uri,
+		"callid": t.callid,
+	})
+	t.timer = time.AfterFunc(cg.timeout, func() {
+		cg.lock.Lock()
+		defer cg.lock.Unlock()
+		if t.ringing {
+			cg.cancel(t)
+		}
+	})
+}
+
+/* must be called with the command locked */
+func (cg *callStartGroupCmd) ringNext() {
+
+	for cg.next < len(cg.targets) {
+		t := cg.targets[cg.next]
+		cg.next++
+		cg.ring(t)
+		if cg.strategy != group_simultaneous && t.ringing {
+			return
+		}
+	}
+	for _, t := range cg.targets {
+		if t.ringing {
+			return
+		}
+	}
+	if cg.winner == nil {
+		cg.fail(errors.New("no callee answered"))
+	}
+}
+
+func (cg *callStartGroupCmd) targetReply(t *groupTarget, response *jsonrpc.JsonRPCResponse) {
+
+	var err error
+
+	cg.lock.Lock()
+	defer cg.lock.Unlock()
+
+	t.ringing = false
+	t.timer.Stop()
+	if response.IsError() {
+		err = response.Error
+	} else {
+		t.ruri, t.dlginfo, err = answeredDialog(response)
+	}
+
+	if err == nil && (cg.winner != nil || cg.done) {
+		/* answered too late - someone else got the call */
+		cg.cmd.proxy.MICall("t_uac_dlg", byeParams(t.ruri, t.dlginfo), nil)
+		return
+	}
+	if cg.done || cg.winner != nil {
+		return
+	}
+
+	if err != nil {
+		cg.cmd.NotifyEvent("TargetFailed", map[string]interface{}{
+			"target": t.uri,
+			"reason": err.Error(),
+		})
+		cg.ringNext()
+		return
+	}
+
+	cg.winner = t
+	for _, o := range cg.targets {
+		if o.ringing {
+			cg.cancel(o)
+		}
+	}
+	cg.cmd.NotifyEvent("TargetAnswered", map[string]interface{}{
+		"target": t.uri,
+		"callid": t.callid,
+	})
+	cg.bridge()
+}
+
+/* must be called with the command locked */
+func (cg *callStartGroupCmd) bridge() {
+
+	var transferFilter = map[string]interface{}{
+		"callid": cg.cmd.ID,
+	}
+	cg.sub = cg.cmd.proxy.SubscribeFilter("E_CALL_TRANSFER", cg.callStartGroupNotify, transferFilter)
+	if cg.sub == nil {
+		cg.cmd.proxy.MICall("t_uac_dlg", byeParams(cg.winner.ruri, cg.winner.dlginfo), nil)
+		cg.fail(errors.New("Could not subscribe for event"))
+		return
+	}
+
+	var transferParams = map[string]string{
+		"callid": cg.cmd.ID,
+		"leg": "callee",
+		"transfer_callid": cg.winner.callid,
+		"transfer_leg": "callee",
+	}
+	err := cg.cmd.proxy.MICall("call_transfer", &transferParams, cg.callStartGroupTransfer)
+	if err != nil {
+		cg.cmd.proxy.MICall("t_uac_dlg", byeParams(cg.winner.ruri, cg.winner.dlginfo), nil)
+		cg.fail(err)
+	}
+}
+
+func (cg *callStartGroupCmd) callStartGroupTransfer(response *jsonrpc.JsonRPCResponse) {
+
+	cg.lock.Lock()
+	defer cg.lock.Unlock()
+
+	if response.IsError() {
+		cg.cmd.proxy.MICall("t_uac_dlg", byeParams(cg.winner.ruri, cg.winner.dlginfo), nil)
+		cg.fail(response.Error)
+		return
+	}
+	if cg.done {
+		return
+	}
+	cg.cmd.NotifyEvent("Transferring", map[string]interface{}{
+		"caller": cg.caller,
+		"destination": cg.winner.uri,
+	})
+}
+
+func (cg *callStartGroupCmd) callStartGroupNotify(sub event.Subscription, notify *jsonrpc.JsonRPCNotification) {
+
+	cg.lock.Lock()
+	defer cg.lock.Unlock()
+
+	if cg.done {
+		return
+	}
+
+	state, err := notify.GetString("state")
+	if err != nil {
+		cg.fail(err)
+		return
+	}
+	status, err := notify.GetString("status")
+	if err != nil {
+		cg.fail(err)
+		return
+	}
+
+	switch state {
+	case "failure":
+		cg.cmd.proxy.MICall("t_uac_dlg", byeParams(cg.winner.ruri, cg.winner.dlginfo), nil)
+		cg.fail(errors.New("transfer failed with status " + status))
+	case "ok":
+		cg.done = true
+		cg.sub.Unsubscribe()
+		cg.cmd.NotifyEvent("CalleeAnswered", map[string]interface{}{
+			"callid": cg.winner.callid,
+			"caller": cg.caller,
+			"callee": cg.winner.uri,
+		})
+		cg.cmd.proxy.MICall("t_uac_dlg", byeParams(cg.ruri, cg.dlginfo), nil)
+		cg.cmd.NotifyEnd()
+	}
+}
+
+func (cg *callStartGroupCmd) callStartGroupInitial(response *jsonrpc.JsonRPCResponse) {
+
+	var err error
+
+	if response.IsError() {
+		cg.cmd.NotifyError(response.Error)
+		return
+	}
+
+	cg.ruri, cg.dlginfo, err = answeredDialog(response)
+	if err != nil {
+		cg.cmd.NotifyError(err)
+		return
+	}
+
+	cg.cmd.NotifyEvent("CallerAnswered", map[string]interface{}{
+		"caller": cg.caller,
+		"strategy": cg.strategy,
+	})
+
+	cg.lock.Lock()
+	defer cg.lock.Unlock()
+	cg.ringNext()
+}
+
+func (c *Cmd) CallStartGroup(params map[string]interface{}) {
+
+	caller, ok := params["caller"].(string)
+	if !ok {
+		c.NotifyNewError("caller not specified")
+		return
+	}
+	callees, ok := params["callees"].([]interface{})
+	if !ok || len(callees) == 0 {
+		c.NotifyNewError("callees not specified")
+		return
+	}
+	targets, err := groupTargets(c.ID, callees)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+
+	strategy, ok := params["strategy"].(string)
+	if !ok {
+		strategy = group_simultaneous
+	}
+	switch strategy {
+	case group_simultaneous, group_sequential:
+	case group_weighted:
+		targets = weightedOrder(targets)
+	default:
+		c.NotifyNewError("invalid strategy " + strategy)
+		return
+	}
+
+	timeout := default_group_timeout
+	if value, ok := params["timeout"].(string); ok {
+		timeout, err = strconv.Atoi(value)
+		if err != nil || timeout <= 0 {
+			c.NotifyNewError("invalid timeout " + value)
+			return
+		}
+	}
+
+	cg := &callStartGroupCmd{
+		cmd: c,
+		caller: caller,
+		ruri: caller,
+		strategy: strategy,
+		timeout: time.Duration(timeout) * time.Second,
+		targets: targets,
+	}
+
+	err = c.proxy.MICall("t_uac_dlg", c.inviteParams(caller, caller, caller, c.ID), cg.callStartGroupInitial)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+}
@@ -0,0 +1,192 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"strconv"
+	"strings"
+)
+
+/* the reply to an offer that is not acceptable */
+const sip_not_acceptable_here int = 488
+
+var sdpDirections = map[string]bool{
+	"sendrecv": true,
+	"sendonly": true,
+	"recvonly": true,
+	"inactive": true,
+}
+
+/* the SDP last negotiated with a leg of a dialog, as listed by the proxy */
+func dialogLegSDP(dialog map[string]interface{}, leg string) (string, bool) {
+	info, _ := dialog[leg].(map[string]interface{})
+	for _, name := range []string{"out_sdp", "sdp"} {
+		if sdp, ok := info[name].(string); ok && sdp != "" {
+			return sdp, true
+		}
+	}
+	return "", false
+}
+
+/* sets the direction of all the media streams of an SDP */
+func sdpSetDirection(sdp, direction string) (string) {
+	var lines []string
+
+	media := false
+	for _, line := range strings.Split(strings.TrimRight(sdp, "\r\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "a=") && sdpDirections[line[2:]] {
+			continue
+		}
+		if strings.HasPrefix(line, "m=") {
+			if media {
+				lines = append(lines, "a=" + direction)
+			}
+			media = true
+		}
+		lines = append(lines, line)
+	}
+	if media {
+		lines = append(lines, "a=" + direction)
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+/* the direction of the first media stream of an SDP - sendrecv by default */
+func sdpDirection(sdp string) (string) {
+	direction := "sendrecv"
+	media := false
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "m=") {
+			if media {
+				break
+			}
+			media = true
+		} else if strings.HasPrefix(line, "a=") && sdpDirections[line[2:]] {
+			/* a media level attribute overrides the session one */
+			direction = line[2:]
+		}
+	}
+	return direction
+}
+
+func (c *Cmd) CallUpdate(params map[string]interface{}) {
+
+	callid, ok := params["callid"].(string)
+	if !ok {
+		c.NotifyNewError("callid not specified")
+		return
+	}
+	leg, ok := params["leg"].(string)
+	if !ok {
+		c.NotifyNewError("leg not specified")
+		return
+	}
+	if !validLeg(leg) {
+		c.NotifyNewError("invalid leg " + leg)
+		return
+	}
+	method, ok := params["method"].(string)
+	if !ok {
+		method = "INVITE"
+	}
+	if method != "INVITE" && method != "UPDATE" {
+		c.NotifyNewError("invalid method " + method)
+		return
+	}
+
+	sdp, hasSDP := params["sdp"].(string)
+	direction, ok := params["direction"].(string)
+	if ok {
+		if !sdpDirections[direction] {
+			c.NotifyNewError("invalid direction " + direction)
+			return
+		}
+		if !hasSDP {
+			/* only the direction changes - the leg gets its current
+			 * session back, with the new direction */
+			dialog, err := findDialog(c, "dlg_list", callid)
+			if err != nil {
+				c.NotifyError(err)
+				return
+			}
+			sdp, hasSDP = dialogLegSDP(dialog, leg)
+			if !hasSDP {
+				c.NotifyNewError("could not find the current SDP of the " + leg + " leg")
+				return
+			}
+		}
+		sdp = sdpSetDirection(sdp, direction)
+	}
+
+	var updateParams = map[string]string{
+		"callid": callid,
+		"mode": leg,
+		"method": method,
+	}
+	/* without a new SDP, the dialog is refreshed with the current one */
+	if hasSDP {
+		updateParams["content_type"] = "application/sdp"
+		updateParams["body"] = sdp
+	}
+
+	c.NotifyEvent("CallUpdating", map[string]interface{}{
+		"callid": callid,
+		"leg": leg,
+		"method": method,
+	})
+
+	ret, err := c.proxy.MICallSync("dlg_send_sequential", &updateParams)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+	if ret.IsError() {
+		if ret.Error.Code != sip_not_acceptable_here {
+			c.NotifyError(ret.Error)
+			return
+		}
+		/* the offer was refused, so the previous session is still in
+		 * place - nothing to undo on the call */
+		c.NotifyEvent("CallUpdateRejected", map[string]interface{}{
+			"callid": callid,
+			"leg": leg,
+			"code": ret.Error.Code,
+			"reason": ret.Error.Message,
+		})
+		c.NotifyNewError("update rejected with status " + strconv.Itoa(ret.Error.Code))
+		return
+	}
+
+	body := map[string]interface{}{
+		"callid": callid,
+		"leg": leg,
+		"method": method,
+	}
+	result, _ := ret.Result.(map[string]interface{})
+	for _, name := range []string{"body", "Body"} {
+		if answer, ok := result[name].(string); ok && answer != "" {
+			body["answer"] = answer
+			body["direction"] = sdpDirection(answer)
+			break
+		}
+	}
+	c.NotifyEvent("CallUpdated", body)
+	c.NotifyEnd()
+}
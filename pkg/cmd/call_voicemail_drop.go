@@ -0,0 +1,157 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/OpenSIPS/call-api/pkg/event"
+	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+)
+
+type callVoicemailDropCmd struct {
+	cmd *Cmd
+	callid, dcallid, file string
+	started time.Time
+	lock sync.Mutex
+	done bool
+	sub event.Subscription
+}
+
+/* the playback call is over, as the media server hung up */
+func (vd *callVoicemailDropCmd) played() {
+	vd.lock.Lock()
+	defer vd.lock.Unlock()
+
+	if vd.done {
+		return
+	}
+	vd.done = true
+	if vd.sub != nil {
+		vd.sub.Unsubscribe()
+	}
+	vd.cmd.NotifyEvent("VoicemailPlayed", map[string]interface{}{
+		"callid": vd.callid,
+		"drop_callid": vd.dcallid,
+		"file": vd.file,
+		"duration": int(time.Since(vd.started).Seconds()),
+	})
+	vd.cmd.NotifyEnd()
+}
+
+func (vd *callVoicemailDropCmd) dlgNotify(sub event.Subscription, notify *jsonrpc.JsonRPCNotification) {
+
+	state, err := notify.Get("new_state")
+	if err == nil && fmt.Sprint(state) == dlg_state_deleted {
+		vd.played()
+	}
+}
+
+func (c *Cmd) CallVoicemailDrop(params map[string]interface{}) {
+
+	callid, ok := params["callid"].(string)
+	if !ok {
+		c.NotifyNewError("callid not specified")
+		return
+	}
+	leg, ok := params["leg"].(string)
+	if !ok {
+		c.NotifyNewError("leg not specified")
+		return
+	}
+	if !validLeg(leg) {
+		c.NotifyNewError("invalid leg " + leg)
+		return
+	}
+	file, ok := params["file"].(string)
+	if !ok {
+		c.NotifyNewError("file not specified")
+		return
+	}
+	destination, err := c.originateTarget(originate_media, file)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+
+	vd := &callVoicemailDropCmd{
+		cmd: c,
+		callid: callid,
+		file: file,
+	}
+	c.NotifyEvent("VoicemailDropping", map[string]interface{}{
+		"callid": callid,
+		"leg": leg,
+		"file": file,
+	})
+
+	/* the customer is sent to the playback, and the agent is released as
+	 * the original call ends */
+	bt := New("CallBlindTransfer", "", c.proxy)
+	err = bt.Run(map[string]interface{}{
+		"callid": callid,
+		"leg": leg,
+		"destination": destination,
+	})
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+	for ev := range bt.Wait() {
+		if ev.IsError() {
+			err = ev.Error
+		} else if ev.Name == "TransferSuccessful" {
+			result, _ := ev.Params.(map[string]interface{})
+			vd.dcallid, _ = result["callid"].(string)
+		}
+	}
+	if err == nil && vd.dcallid == "" {
+		err = errors.New("could not find the playback call")
+	}
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+	vd.started = time.Now()
+	c.NotifyEvent("VoicemailDropped", map[string]interface{}{
+		"callid": callid,
+		"drop_callid": vd.dcallid,
+		"file": file,
+	})
+
+	var dropFilter = map[string]interface{}{
+		"callid": vd.dcallid,
+	}
+	vd.lock.Lock()
+	vd.sub = c.proxy.SubscribeFilter("E_DLG_STATE_CHANGED", vd.dlgNotify, dropFilter)
+	if vd.sub == nil {
+		vd.done = true
+		vd.lock.Unlock()
+		c.NotifyNewError("Could not subscribe for event")
+		return
+	}
+	vd.lock.Unlock()
+
+	/* the playback may have ended before subscribing */
+	if _, err := findDialog(c, "dlg_list", vd.dcallid); err != nil {
+		vd.played()
+	}
+}
@@ -0,0 +1,165 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/OpenSIPS/call-api/pkg/event"
+	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+)
+
+const default_dtmf_event string = "E_CALL_DTMF"
+
+type callWatchDTMFCmd struct {
+	cmd *Cmd
+	callid, leg string
+	lock sync.Mutex
+	done bool
+	dtmfSub, dlgSub event.Subscription
+}
+
+func (cw *callWatchDTMFCmd) end(err error) {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+
+	if cw.done {
+		return
+	}
+	cw.done = true
+	cw.dtmfSub.Unsubscribe()
+	cw.dlgSub.Unsubscribe()
+	if err != nil {
+		cw.cmd.NotifyError(err)
+	} else {
+		cw.cmd.NotifyEnd()
+	}
+}
+
+func (cw *callWatchDTMFCmd) callWatchDTMFNotify(sub event.Subscription, notify *jsonrpc.JsonRPCNotification) {
+
+	digit, err := notify.GetString("digit")
+	if err != nil {
+		cw.end(err)
+		return
+	}
+
+	leg, err := notify.GetString("leg")
+	if err != nil {
+		cw.end(err)
+		return
+	}
+	if cw.leg != "" && leg != cw.leg {
+		return
+	}
+
+	/* the time the digit was received, not the time it is handled at */
+	received := notify.Received
+	if received.IsZero() {
+		received = time.Now()
+	}
+	data := map[string]interface{}{
+		"callid": cw.callid,
+		"leg": leg,
+		"digit": digit,
+		"timestamp": received.UTC().Format(time.RFC3339Nano),
+	}
+	if method, err := notify.GetString("method"); err == nil && method != "" {
+		data["method"] = method
+	}
+
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	if !cw.done {
+		cw.cmd.NotifyEvent("DTMFReceived", data)
+	}
+}
+
+func (cw *callWatchDTMFCmd) callWatchDlgNotify(sub event.Subscription, notify *jsonrpc.JsonRPCNotification) {
+
+	state, err := notify.Get("new_state")
+	if err != nil {
+		cw.end(err)
+		return
+	}
+	if fmt.Sprint(state) == dlg_state_deleted {
+		cw.end(nil)
+	}
+}
+
+func (c *Cmd) CallWatchDTMF(params map[string]interface{}) {
+
+	callid, ok := params["callid"].(string)
+	if !ok {
+		c.NotifyNewError("callid not specified")
+		return
+	}
+	cw := &callWatchDTMFCmd{
+		cmd: c,
+		callid: callid,
+	}
+	if leg, ok := params["leg"].(string); ok {
+		if !validLeg(leg) {
+			c.NotifyNewError("invalid leg " + leg)
+			return
+		}
+		cw.leg = leg
+	}
+
+	name := default_dtmf_event
+	if cfg := c.proxy.GetConfig(); cfg.DTMF.Event != "" {
+		name = cfg.DTMF.Event
+	}
+
+	var callFilter = map[string]interface{}{
+		"callid": callid,
+	}
+
+	/* hold the events until both subscriptions are in place */
+	cw.lock.Lock()
+
+	cw.dtmfSub = c.proxy.SubscribeFilter(name, cw.callWatchDTMFNotify, callFilter)
+	if cw.dtmfSub == nil {
+		cw.done = true
+		cw.lock.Unlock()
+		c.NotifyNewError("Could not subscribe for event")
+		return
+	}
+
+	/* the watch lasts as long as the call does */
+	cw.dlgSub = c.proxy.SubscribeFilter("E_DLG_STATE_CHANGED", cw.callWatchDlgNotify, callFilter)
+	if cw.dlgSub == nil {
+		cw.done = true
+		cw.dtmfSub.Unsubscribe()
+		cw.lock.Unlock()
+		c.NotifyNewError("Could not subscribe for event")
+		return
+	}
+
+	c.NotifyEvent("DTMFWatching", map[string]interface{}{
+		"callid": callid,
+	})
+	cw.lock.Unlock()
+
+	/* the call may not exist, or may have ended before subscribing */
+	if _, err := findDialog(c, "dlg_list", callid); err != nil {
+		cw.end(err)
+	}
+}
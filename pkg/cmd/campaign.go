@@ -0,0 +1,541 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	outcome_answered = "answered"
+	outcome_busy = "busy"
+	outcome_no_answer = "no_answer"
+	outcome_failed = "failed"
+)
+
+/* how often the campaign checks whether it can originate new calls */
+const campaign_tick = time.Second
+
+type campaignRetry struct {
+	attempts int
+	delay time.Duration
+}
+
+type campaignRecord struct {
+	id, callee string
+	attempt int
+	retries map[string]int /* retries done, by outcome */
+	notBefore time.Time
+}
+
+// campaignWindow - the hours (and optionally the days) calls are allowed in
+type campaignWindow struct {
+	start, end int /* minutes since midnight */
+	days map[time.Weekday]bool
+	location *time.Location
+}
+
+type campaign struct {
+	cmd *Cmd
+	lock sync.Mutex
+	wake chan struct{}
+
+	queue []*campaignRecord
+	agents []string /* the agents that are not in a call */
+	concurrency int
+	pacing time.Duration
+	retries map[string]*campaignRetry
+	window *campaignWindow
+
+	active int
+	lastCall time.Time
+	paused, stopped, waiting bool
+	ended bool /* no more events can be notified */
+
+	total int
+	outcomes map[string]int
+}
+
+var campaignsLock sync.Mutex
+var campaigns = make(map[string]*campaign)
+
+func getCampaign(id string) (*campaign) {
+	campaignsLock.Lock()
+	defer campaignsLock.Unlock()
+	return campaigns[id]
+}
+
+/* parses a numeric parameter, given either as a number or as a string */
+func intParam(v interface{}, name string) (int, error) {
+	switch n := v.(type) {
+	case float64:
+		if n >= 0 && n == float64(int(n)) {
+			return int(n), nil
+		}
+	case string:
+		i, err := strconv.Atoi(n)
+		if err == nil && i >= 0 {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid %s %v", name, v)
+}
+
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, errors.New("invalid hour " + clock)
+	}
+	return t.Hour() * 60 + t.Minute(), nil
+}
+
+func parseWindow(params map[string]interface{}) (*campaignWindow, error) {
+	var err error
+
+	w := &campaignWindow{location: time.Local}
+	start, ok := params["start"].(string)
+	if !ok {
+		return nil, errors.New("hours start not specified")
+	}
+	if w.start, err = parseClock(start); err != nil {
+		return nil, err
+	}
+	end, ok := params["end"].(string)
+	if !ok {
+		return nil, errors.New("hours end not specified")
+	}
+	if w.end, err = parseClock(end); err != nil {
+		return nil, err
+	}
+	if tz, ok := params["timezone"].(string); ok {
+		if w.location, err = time.LoadLocation(tz); err != nil {
+			return nil, errors.New("invalid timezone " + tz)
+		}
+	}
+	if days, ok := params["days"].([]interface{}); ok {
+		w.days = make(map[time.Weekday]bool)
+		for _, d := range days {
+			name, _ := d.(string)
+			found := false
+			for wd := time.Sunday; wd <= time.Saturday; wd++ {
+				if strings.EqualFold(name, wd.String()[:3]) || strings.EqualFold(name, wd.String()) {
+					w.days[wd] = true
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("invalid day %v", d)
+			}
+		}
+	}
+	return w, nil
+}
+
+func (w *campaignWindow) allows(now time.Time) (bool) {
+	now = now.In(w.location)
+	if w.days != nil && !w.days[now.Weekday()] {
+		return false
+	}
+	minute := now.Hour() * 60 + now.Minute()
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	/* the window spans over midnight */
+	return minute >= w.start || minute < w.end
+}
+
+func parseRecords(records []interface{}) ([]*campaignRecord, error) {
+	var list []*campaignRecord
+
+	for i, r := range records {
+		rec := &campaignRecord{
+			id: strconv.Itoa(i + 1),
+			retries: make(map[string]int),
+		}
+		switch v := r.(type) {
+		case string:
+			rec.callee = v
+		case map[string]interface{}:
+			callee, ok := v["callee"].(string)
+			if !ok {
+				return nil, fmt.Errorf("callee of record %d not specified", i + 1)
+			}
+			rec.callee = callee
+			if id, ok := v["id"].(string); ok {
+				rec.id = id
+			}
+		default:
+			return nil, fmt.Errorf("invalid record %d", i + 1)
+		}
+		list = append(list, rec)
+	}
+	return list, nil
+}
+
+func parseRetries(params map[string]interface{}) (map[string]*campaignRetry, error) {
+	retries := make(map[string]*campaignRetry)
+
+	for outcome, v := range params {
+		switch outcome {
+		case outcome_busy, outcome_no_answer, outcome_failed:
+		default:
+			return nil, errors.New("invalid retry outcome " + outcome)
+		}
+		rule, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("invalid retry rule for " + outcome)
+		}
+		r := &campaignRetry{}
+		attempts, err := intParam(rule["attempts"], outcome + " attempts")
+		if err != nil {
+			return nil, err
+		}
+		r.attempts = attempts
+		if rule["delay"] != nil {
+			delay, err := intParam(rule["delay"], outcome + " delay")
+			if err != nil {
+				return nil, err
+			}
+			r.delay = time.Duration(delay) * time.Second
+		}
+		retries[outcome] = r
+	}
+	return retries, nil
+}
+
+/* classifies the way a CallStart origination ended */
+func callOutcome(err error) (string) {
+	if err == nil {
+		return outcome_answered
+	}
+	var te *TransferError
+	if !errors.As(err, &te) {
+		/* the agent could not be reached */
+		return outcome_failed
+	}
+	switch te.Code() {
+	case 486, 600:
+		return outcome_busy
+	case 408, 480, 487:
+		return outcome_no_answer
+	}
+	return outcome_failed
+}
+
+/* must be called with the campaign locked */
+func (cp *campaign) progress() {
+	body := map[string]interface{}{
+		"total": cp.total,
+		"in_progress": cp.active,
+		"pending": len(cp.queue),
+	}
+	completed := 0
+	for _, outcome := range []string{outcome_answered, outcome_busy, outcome_no_answer, outcome_failed} {
+		body[outcome] = cp.outcomes[outcome]
+		completed += cp.outcomes[outcome]
+	}
+	body["completed"] = completed
+	cp.cmd.NotifyEvent("CampaignProgress", body)
+}
+
+func (cp *campaign) signal() {
+	select {
+	case cp.wake <- struct{}{}:
+	default:
+	}
+}
+
+/* must be called with the campaign locked */
+func (cp *campaign) nextRecord(now time.Time) (*campaignRecord) {
+	for i, rec := range cp.queue {
+		if !rec.notBefore.After(now) {
+			cp.queue = append(cp.queue[:i], cp.queue[i+1:]...)
+			return rec
+		}
+	}
+	return nil
+}
+
+func (cp *campaign) originate(rec *campaignRecord, agent string) {
+
+	cs := New("CallStart", "", cp.cmd.proxy)
+	err := cs.Run(map[string]interface{}{
+		"caller": agent,
+		"callee": rec.callee,
+	})
+	if err == nil {
+		for ev := range cs.Wait() {
+			if ev.IsError() {
+				err = ev.Error
+			}
+		}
+	}
+	outcome := callOutcome(err)
+	if err != nil && outcome != outcome_failed {
+		/* the agent is still in the call set up for the callee */
+		var endParams = map[string]string{
+			"dialog_id": cs.ID,
+		}
+		cp.cmd.proxy.MICall("dlg_end_dlg", &endParams, nil)
+	}
+
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	cp.active--
+	cp.agents = append(cp.agents, agent)
+
+	body := map[string]interface{}{
+		"record": rec.id,
+		"callee": rec.callee,
+		"agent": agent,
+		"attempt": rec.attempt,
+		"outcome": outcome,
+	}
+	if err != nil {
+		body["reason"] = err.Error()
+		var te *TransferError
+		if errors.As(err, &te) && te.Code() != 0 {
+			body["status"] = te.Code()
+		}
+	}
+	if rule, ok := cp.retries[outcome]; ok && rec.retries[outcome] < rule.attempts && !cp.stopped {
+		rec.retries[outcome]++
+		rec.notBefore = time.Now().Add(rule.delay)
+		cp.queue = append(cp.queue, rec)
+		body["retry_in"] = int(rule.delay / time.Second)
+	} else {
+		cp.outcomes[outcome]++
+	}
+	cp.cmd.NotifyEvent("RecordOutcome", body)
+	cp.progress()
+	cp.signal()
+}
+
+/* starts as many calls as allowed; must be called with the campaign locked */
+func (cp *campaign) schedule(now time.Time) {
+
+	if cp.paused || cp.stopped {
+		return
+	}
+	if cp.window != nil && !cp.window.allows(now) {
+		if !cp.waiting && len(cp.queue) != 0 {
+			cp.waiting = true
+			cp.cmd.NotifyEvent("CampaignWaiting", nil)
+		}
+		return
+	}
+	cp.waiting = false
+
+	for cp.active < cp.concurrency && len(cp.agents) != 0 {
+		if cp.pacing != 0 && now.Sub(cp.lastCall) < cp.pacing {
+			return
+		}
+		rec := cp.nextRecord(now)
+		if rec == nil {
+			return
+		}
+		agent := cp.agents[0]
+		cp.agents = cp.agents[1:]
+		cp.active++
+		cp.lastCall = now
+		rec.attempt++
+		cp.cmd.NotifyEvent("RecordStarted", map[string]interface{}{
+			"record": rec.id,
+			"callee": rec.callee,
+			"agent": agent,
+			"attempt": rec.attempt,
+		})
+		go cp.originate(rec, agent)
+	}
+}
+
+func (cp *campaign) run() {
+
+	ticker := time.NewTicker(campaign_tick)
+	defer ticker.Stop()
+
+	for {
+		cp.lock.Lock()
+		cp.schedule(time.Now())
+		if cp.active == 0 && (cp.stopped || len(cp.queue) == 0) {
+			break
+		}
+		cp.lock.Unlock()
+
+		select {
+		case <-cp.wake:
+		case <-ticker.C:
+		}
+	}
+
+	campaignsLock.Lock()
+	delete(campaigns, cp.cmd.ID)
+	campaignsLock.Unlock()
+
+	if cp.stopped {
+		cp.cmd.NotifyEvent("CampaignStopped", nil)
+		cp.progress()
+	}
+	/* a control command might still hold the campaign, so it must find it
+	 * ended once it gets the lock */
+	cp.ended = true
+	cp.cmd.NotifyEnd()
+	cp.lock.Unlock()
+}
+
+func (c *Cmd) CampaignStart(params map[string]interface{}) {
+	var err error
+
+	records, ok := params["records"].([]interface{})
+	if !ok || len(records) == 0 {
+		c.NotifyNewError("records not specified")
+		return
+	}
+	agents, ok := params["agents"].([]interface{})
+	if !ok || len(agents) == 0 {
+		c.NotifyNewError("agents not specified")
+		return
+	}
+
+	cp := &campaign{
+		cmd: c,
+		wake: make(chan struct{}, 1),
+		concurrency: len(agents),
+		retries: make(map[string]*campaignRetry),
+		outcomes: make(map[string]int),
+	}
+	for _, a := range agents {
+		agent, ok := a.(string)
+		if !ok {
+			c.NotifyNewError("invalid agent")
+			return
+		}
+		cp.agents = append(cp.agents, agent)
+	}
+	if cp.queue, err = parseRecords(records); err != nil {
+		c.NotifyError(err)
+		return
+	}
+	cp.total = len(cp.queue)
+
+	if v, ok := params["concurrency"]; ok {
+		if cp.concurrency, err = intParam(v, "concurrency"); err != nil || cp.concurrency == 0 {
+			c.NotifyNewError("invalid concurrency")
+			return
+		}
+	}
+	if v, ok := params["pacing"]; ok {
+		pacing, err := intParam(v, "pacing")
+		if err != nil {
+			c.NotifyError(err)
+			return
+		}
+		cp.pacing = time.Duration(pacing) * time.Millisecond
+	}
+	if v, ok := params["retries"].(map[string]interface{}); ok {
+		if cp.retries, err = parseRetries(v); err != nil {
+			c.NotifyError(err)
+			return
+		}
+	}
+	if v, ok := params["hours"].(map[string]interface{}); ok {
+		if cp.window, err = parseWindow(v); err != nil {
+			c.NotifyError(err)
+			return
+		}
+	}
+
+	campaignsLock.Lock()
+	campaigns[c.ID] = cp
+	campaignsLock.Unlock()
+
+	c.NotifyEvent("CampaignStarted", map[string]interface{}{
+		"campaign_id": c.ID,
+		"total": cp.total,
+	})
+	cp.run()
+}
+
+/* runs an action on a running campaign, on behalf of c */
+func (c *Cmd) campaignControl(params map[string]interface{}, action func(cp *campaign) (error)) {
+
+	id, ok := params["campaign_id"].(string)
+	if !ok {
+		c.NotifyNewError("campaign_id not specified")
+		return
+	}
+	cp := getCampaign(id)
+	if cp == nil || !c.owns(cp.cmd) {
+		c.NotifyNewError("unknown campaign " + id)
+		return
+	}
+
+	cp.lock.Lock()
+	if cp.ended {
+		cp.lock.Unlock()
+		c.NotifyNewError("unknown campaign " + id)
+		return
+	}
+	err := action(cp)
+	cp.lock.Unlock()
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+	cp.signal()
+	c.NotifyEnd()
+}
+
+func (c *Cmd) CampaignPause(params map[string]interface{}) {
+	c.campaignControl(params, func(cp *campaign) (error) {
+		if cp.stopped {
+			return errors.New("campaign is stopping")
+		}
+		if !cp.paused {
+			cp.paused = true
+			cp.cmd.NotifyEvent("CampaignPaused", nil)
+		}
+		return nil
+	})
+}
+
+func (c *Cmd) CampaignResume(params map[string]interface{}) {
+	c.campaignControl(params, func(cp *campaign) (error) {
+		if cp.stopped {
+			return errors.New("campaign is stopping")
+		}
+		if cp.paused {
+			cp.paused = false
+			cp.cmd.NotifyEvent("CampaignResumed", nil)
+		}
+		return nil
+	})
+}
+
+func (c *Cmd) CampaignStop(params map[string]interface{}) {
+	c.campaignControl(params, func(cp *campaign) (error) {
+		cp.stopped = true
+		return nil
+	})
+}
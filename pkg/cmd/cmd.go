@@ -20,22 +20,97 @@ package cmd
 import (
 	"errors"
 	"fmt"
-	"reflect"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/OpenSIPS/call-api/pkg/metrics"
 	"github.com/OpenSIPS/call-api/pkg/proxy"
 )
 
 type Notify func(cmd *Cmd, notify interface{})
 
+type handler func(c *Cmd, params map[string]interface{})
+
+/* the commands a client may run - anything else is an unknown method, even
+ * if it happens to be an exported method of Cmd */
+var commands map[string]handler
+
+/* filled at init, as some commands start others through New() */
+func init() {
+	commands = map[string]handler{
+		"CallAttendedTransfer": (*Cmd).CallAttendedTransfer,
+		"CallBarge": (*Cmd).CallBarge,
+		"CallBlindTransfer": (*Cmd).CallBlindTransfer,
+		"CallConference": (*Cmd).CallConference,
+		"CallConferenceEnd": (*Cmd).CallConferenceEnd,
+		"CallConferenceKick": (*Cmd).CallConferenceKick,
+		"CallEnd": (*Cmd).CallEnd,
+		"CallHold": (*Cmd).CallHold,
+		"CallListen": (*Cmd).CallListen,
+		"CallMute": (*Cmd).CallMute,
+		"CallPark": (*Cmd).CallPark,
+		"CallPickup": (*Cmd).CallPickup,
+		"CallPlay": (*Cmd).CallPlay,
+		"CallRecordPause": (*Cmd).CallRecordPause,
+		"CallRecordResume": (*Cmd).CallRecordResume,
+		"CallRecordStart": (*Cmd).CallRecordStart,
+		"CallRecordStop": (*Cmd).CallRecordStop,
+		"CallRedirect": (*Cmd).CallRedirect,
+		"CallRetrieve": (*Cmd).CallRetrieve,
+		"CallSchedule": (*Cmd).CallSchedule,
+		"CallScheduleCancel": (*Cmd).CallScheduleCancel,
+		"CallScheduleList": (*Cmd).CallScheduleList,
+		"CallSendDTMF": (*Cmd).CallSendDTMF,
+		"CallStart": (*Cmd).CallStart,
+		"CallStartGroup": (*Cmd).CallStartGroup,
+		"CallStopPlay": (*Cmd).CallStopPlay,
+		"CallUnhold": (*Cmd).CallUnhold,
+		"CallUnmute": (*Cmd).CallUnmute,
+		"CallUpdate": (*Cmd).CallUpdate,
+		"CallVoicemailDrop": (*Cmd).CallVoicemailDrop,
+		"CallWatchDTMF": (*Cmd).CallWatchDTMF,
+		"CallWhisper": (*Cmd).CallWhisper,
+		"CampaignPause": (*Cmd).CampaignPause,
+		"CampaignResume": (*Cmd).CampaignResume,
+		"CampaignStart": (*Cmd).CampaignStart,
+		"CampaignStop": (*Cmd).CampaignStop,
+		"Echo": (*Cmd).Echo,
+		"ForwardClear": (*Cmd).ForwardClear,
+		"ForwardGet": (*Cmd).ForwardGet,
+		"ForwardSet": (*Cmd).ForwardSet,
+		"MessageWatch": (*Cmd).MessageWatch,
+		"Originate": (*Cmd).Originate,
+		"SendMessage": (*Cmd).SendMessage,
+		"Test": (*Cmd).Test,
+		"TransferCancel": (*Cmd).TransferCancel,
+		"TransferComplete": (*Cmd).TransferComplete,
+		"TransferConsult": (*Cmd).TransferConsult,
+		"TransferSwap": (*Cmd).TransferSwap,
+		"UserLocation": (*Cmd).UserLocation,
+	}
+}
+
+var (
+	cmdStarted = metrics.NewCounterVec("call_api_commands_started_total",
+		"Number of commands started, by method.", "method")
+	cmdSucceeded = metrics.NewCounterVec("call_api_commands_succeeded_total",
+		"Number of commands that ended successfully, by method.", "method")
+	cmdFailed = metrics.NewCounterVec("call_api_commands_failed_total",
+		"Number of commands that ended with an error, by method.", "method")
+	cmdDuration = metrics.NewHistogramVec("call_api_command_duration_seconds",
+		"Duration of the commands, from start until they end, by method.",
+		[]float64{.1, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}, "method")
+)
 
 type Cmd struct {
 	ID string
 	Command string
 
 	proxy *proxy.Proxy
+	identity string /* set when the command is tracked */
 	notify chan *CmdEvent
-	hdl reflect.Value
+	hdl handler
+	started time.Time
 }
 
 func New(command string, id string, p *proxy.Proxy) (c *Cmd) {
@@ -50,24 +125,31 @@ func New(command string, id string, p *proxy.Proxy) (c *Cmd) {
 		c.ID = uuid.New().String()
 	}
 
-	c.hdl = reflect.ValueOf(c).MethodByName(command)
-	if !c.hdl.IsValid() {
+	hdl, ok := commands[command]
+	if !ok {
 		return nil
 	}
+	c.hdl = hdl
 	return c
 }
 
 func (c *Cmd) Run(params map[string]interface{}) (err error) {
-	// TODO: remove this check once non-strings are handled under the hood
+	// TODO: remove this check once numbers are handled under the hood
 	for key := range params {
-		if _, ok := params[key].(string); !ok {
-			err = fmt.Errorf("non-string parameter values are not yet supported")
+		switch params[key].(type) {
+		case string, bool, map[string]interface{}, []interface{}:
+		default:
+			err = fmt.Errorf("only string, boolean, object and array parameter values are supported")
+			/* the command will never run, so nothing will be notified */
+			close(c.notify)
 			return
 		}
 	}
 
-	in := []reflect.Value{reflect.ValueOf(params)}
-	go c.hdl.Call(in)
+	c.started = time.Now()
+	cmdStarted.Inc(c.Command)
+
+	go c.hdl(c, params)
 	return
 }
 
@@ -94,15 +176,35 @@ func (c *Cmd) Notify(ce *CmdEvent) {
 	c.notify <- ce
 }
 
+/* Account the termination of the command */
+func (c *Cmd) finish(success bool) {
+	if success {
+		cmdSucceeded.Inc(c.Command)
+	} else {
+		cmdFailed.Inc(c.Command)
+	}
+	if !c.started.IsZero() {
+		cmdDuration.Observe(time.Since(c.started).Seconds(), c.Command)
+	}
+}
+
+/* Check whether c may act on what owner started, just like the scheduler
+ * only shows the calls of an identity to itself */
+func (c *Cmd) owns(owner *Cmd) (bool) {
+	return c.identity == "" || c.identity == owner.identity
+}
+
 /* Notify an existing error - closes the channel */
 func (c *Cmd) NotifyError(err error) {
 	c.Notify(NewError(err))
+	c.finish(false)
 	close(c.notify)
 }
 
 /* Notify a new error - closes the channel */
 func (c *Cmd) NotifyNewError(err string ) {
 	c.Notify(NewError(errors.New(err)))
+	c.finish(false)
 	close(c.notify)
 }
 
@@ -113,5 +215,6 @@ func (c *Cmd) NotifyEvent(name string, event interface{}) {
 
 /* Notify the termination of the command handling */
 func (c *Cmd) NotifyEnd() {
+	c.finish(true)
 	close(c.notify)
 }
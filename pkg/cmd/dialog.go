@@ -0,0 +1,88 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"errors"
+)
+
+/* the dialog state reported once the dialog is gone */
+const dlg_state_deleted string = "5"
+
+/* the dialog states of a call that was not answered yet */
+const (
+	dlg_state_unconfirmed = "1"
+	dlg_state_early = "2"
+)
+
+/* returns the dialog of a call, as listed by the dlg_list* MI command */
+func findDialog(c *Cmd, command, callid string) (map[string]interface{}, error) {
+	var listParams = map[string]string{
+		"callid": callid,
+	}
+	ret, err := c.proxy.MICallSync(command, &listParams)
+	if err != nil {
+		return nil, err
+	}
+	if ret.IsError() {
+		return nil, ret.Error
+	}
+
+	result, _ := ret.Result.(map[string]interface{})
+	dialogs, _ := result["Dialogs"].([]interface{})
+	if len(dialogs) == 0 {
+		return nil, errors.New("unknown dialog " + callid)
+	}
+	dialog, _ := dialogs[0].(map[string]interface{})
+	return dialog, nil
+}
+
+/* returns the URI of a participant of a dialog */
+func dialogParty(c *Cmd, callid, leg string) (string, error) {
+	dialog, err := findDialog(c, "dlg_list", callid)
+	if err != nil {
+		return "", err
+	}
+	name := "from_uri"
+	if leg == "callee" {
+		name = "to_uri"
+	}
+	uri, ok := dialog[name].(string)
+	if !ok || uri == "" {
+		return "", errors.New("could not find the " + leg + " of dialog " + callid)
+	}
+	return uri, nil
+}
+
+/* looks for a value stored by the script in the context of a dialog */
+func dialogValue(dialog map[string]interface{}, name string) (string, bool) {
+	context, _ := dialog["context"].(map[string]interface{})
+	switch values := context["values"].(type) {
+	case map[string]interface{}:
+		value, ok := values[name].(string)
+		return value, ok
+	case []interface{}:
+		for _, v := range values {
+			pair, _ := v.(map[string]interface{})
+			if value, ok := pair[name].(string); ok {
+				return value, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,264 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	forward_unconditional = "unconditional"
+	forward_busy = "busy"
+	forward_no_answer = "no_answer"
+	forward_time = "time"
+)
+
+const default_forward_cache string = "local"
+const default_forward_prefix string = "forward_"
+const default_forward_timeout int = 20
+
+// forwardRule - a call forwarding rule, as stored for the script to use
+type forwardRule struct {
+	Type string `json:"type"`
+	Destination string `json:"destination"`
+	Timeout int `json:"timeout,omitempty"`
+	Hours map[string]interface{} `json:"hours,omitempty"`
+}
+
+/* validates the rules, as given by the client */
+func parseForwardRules(rules []interface{}) ([]*forwardRule, error) {
+	var err error
+
+	list := make([]*forwardRule, 0)
+	seen := make(map[string]bool)
+	for _, r := range rules {
+		params, ok := r.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("invalid rule")
+		}
+		rule := &forwardRule{}
+		rule.Type, ok = params["type"].(string)
+		if !ok {
+			return nil, errors.New("rule type not specified")
+		}
+		rule.Destination, ok = params["destination"].(string)
+		if !ok || !strings.Contains(rule.Destination, ":") {
+			return nil, errors.New("invalid destination for " + rule.Type + " rule")
+		}
+
+		switch rule.Type {
+		case forward_unconditional, forward_busy:
+		case forward_no_answer:
+			rule.Timeout = default_forward_timeout
+			if timeout, ok := params["timeout"]; ok {
+				rule.Timeout, err = intParam(timeout, "timeout")
+				if err != nil {
+					return nil, err
+				}
+				if rule.Timeout == 0 {
+					return nil, errors.New("invalid timeout 0")
+				}
+			}
+		case forward_time:
+			hours, ok := params["hours"].(map[string]interface{})
+			if !ok {
+				return nil, errors.New("hours not specified for time rule")
+			}
+			if _, err = parseWindow(hours); err != nil {
+				return nil, err
+			}
+			rule.Hours = hours
+		default:
+			return nil, errors.New("invalid rule type " + rule.Type)
+		}
+
+		/* several time rules may cover different hours */
+		if rule.Type != forward_time {
+			if seen[rule.Type] {
+				return nil, errors.New("duplicate " + rule.Type + " rule")
+			}
+			seen[rule.Type] = true
+		}
+		list = append(list, rule)
+	}
+	return list, nil
+}
+
+/* the rules, as reported to the client */
+func forwardRulesBody(rules []*forwardRule) ([]interface{}) {
+	list := make([]interface{}, 0)
+	for _, rule := range rules {
+		body := map[string]interface{}{
+			"type": rule.Type,
+			"destination": rule.Destination,
+		}
+		switch rule.Type {
+		case forward_no_answer:
+			body["timeout"] = rule.Timeout
+		case forward_time:
+			body["hours"] = rule.Hours
+			if w, err := parseWindow(rule.Hours); err == nil {
+				body["active"] = w.allows(time.Now())
+			}
+		}
+		list = append(list, body)
+	}
+	return list
+}
+
+/* the cache system, and the key the rules of a user are stored under */
+func (c *Cmd) forwardKey(params map[string]interface{}) (string, string, error) {
+
+	user, ok := params["user"].(string)
+	if !ok {
+		return "", "", errors.New("user not specified")
+	}
+	cfg := c.proxy.GetConfig()
+	system := cfg.Forward.CacheSystem
+	if system == "" {
+		system = default_forward_cache
+	}
+	prefix := cfg.Forward.KeyPrefix
+	if prefix == "" {
+		prefix = default_forward_prefix
+	}
+	return system, prefix + c.locationAOR(user), nil
+}
+
+/* the rules stored for a user - none, if the key is not found */
+func (c *Cmd) fetchForwardRules(system, key string) ([]*forwardRule, error) {
+
+	var fetchParams = map[string]string{
+		"system": system,
+		"attr": key,
+	}
+	ret, err := c.proxy.MICallSync("cache_fetch", &fetchParams)
+	if err != nil {
+		return nil, err
+	}
+	if ret.IsError() {
+		if ret.Error.Code == 404 {
+			return make([]*forwardRule, 0), nil
+		}
+		return nil, ret.Error
+	}
+	value, err := ret.GetString("value")
+	if err != nil {
+		return nil, err
+	}
+	var rules []*forwardRule
+	if err = json.Unmarshal([]byte(value), &rules); err != nil {
+		return nil, fmt.Errorf("invalid forwarding rules for %s: %s", key, err)
+	}
+	return rules, nil
+}
+
+func (c *Cmd) ForwardSet(params map[string]interface{}) {
+
+	system, key, err := c.forwardKey(params)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+	list, ok := params["rules"].([]interface{})
+	if !ok || len(list) == 0 {
+		c.NotifyNewError("rules not specified")
+		return
+	}
+	rules, err := parseForwardRules(list)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+	value, err := json.Marshal(rules)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+
+	var storeParams = map[string]string{
+		"system": system,
+		"attr": key,
+		"value": string(value),
+	}
+	ret, err := c.proxy.MICallSync("cache_store", &storeParams)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+	if ret.IsError() {
+		c.NotifyError(ret.Error)
+		return
+	}
+	c.NotifyEvent("ForwardRulesSet", map[string]interface{}{
+		"user": params["user"],
+		"rules": forwardRulesBody(rules),
+	})
+	c.NotifyEnd()
+}
+
+func (c *Cmd) ForwardGet(params map[string]interface{}) {
+
+	system, key, err := c.forwardKey(params)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+	rules, err := c.fetchForwardRules(system, key)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+	c.NotifyEvent("ForwardRules", map[string]interface{}{
+		"user": params["user"],
+		"rules": forwardRulesBody(rules),
+	})
+	c.NotifyEnd()
+}
+
+func (c *Cmd) ForwardClear(params map[string]interface{}) {
+
+	system, key, err := c.forwardKey(params)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+
+	var removeParams = map[string]string{
+		"system": system,
+		"attr": key,
+	}
+	ret, err := c.proxy.MICallSync("cache_remove", &removeParams)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+	/* clearing a user without rules is not an error */
+	if ret.IsError() && ret.Error.Code != 404 {
+		c.NotifyError(ret.Error)
+		return
+	}
+	c.NotifyEvent("ForwardCleared", map[string]interface{}{
+		"user": params["user"],
+	})
+	c.NotifyEnd()
+}
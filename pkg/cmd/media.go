@@ -0,0 +1,46 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+)
+
+/* runs a command of the media relay, such as rtpengine_block_media */
+func (c *Cmd) mediaCall(action string, params interface{}) (*jsonrpc.JsonRPCResponse, error) {
+
+	ret, err := c.proxy.MICallSync(c.proxy.MediaRelay() + "_" + action, params)
+	if err != nil {
+		return nil, err
+	}
+	if ret.IsError() {
+		return nil, ret.Error
+	}
+	return ret, nil
+}
+
+func validLeg(leg string) (bool) {
+	return leg == "caller" || leg == "callee"
+}
+
+func otherLeg(leg string) (string) {
+	if leg == "caller" {
+		return "callee"
+	}
+	return "caller"
+}
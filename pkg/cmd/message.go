@@ -0,0 +1,214 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenSIPS/call-api/pkg/event"
+	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+)
+
+const default_message_content_type string = "text/plain"
+const default_message_event string = "E_SIP_MESSAGE"
+
+const messageHeadersFormat = "From: <%s>\r\n" +
+	"To: <%s>\r\n" +
+	"Content-Type: %s\r\n" +
+	"CSeq: 1 MESSAGE\r\n" +
+	"Call-Id: %s\r\n"
+
+type sendMessageCmd struct {
+	cmd *Cmd
+	to string
+}
+
+func (sm *sendMessageCmd) sendMessageReply(response *jsonrpc.JsonRPCResponse) {
+
+	if response.IsError() {
+		sm.cmd.NotifyError(response.Error)
+		return
+	}
+
+	status, err := response.GetString("Status")
+	if err != nil {
+		sm.cmd.NotifyError(err)
+		return
+	}
+
+	reply := strings.SplitN(status, " ", 2)
+	code, err := strconv.Atoi(reply[0])
+	if err != nil {
+		sm.cmd.NotifyNewError("invalid reply status " + status)
+		return
+	}
+	data := map[string]interface{}{
+		"to": sm.to,
+		"code": code,
+	}
+	if len(reply) > 1 {
+		data["reason"] = reply[1]
+	}
+	sm.cmd.NotifyEvent("MessageResponse", data)
+
+	if code >= 300 {
+		sm.cmd.NotifyNewError("message failed with status " + status)
+		return
+	}
+	sm.cmd.NotifyEnd()
+}
+
+func (c *Cmd) SendMessage(params map[string]interface{}) {
+
+	cfg := c.proxy.GetConfig()
+
+	to, ok := params["to"].(string)
+	if !ok {
+		c.NotifyNewError("to not specified")
+		return
+	}
+	body, ok := params["body"].(string)
+	if !ok {
+		c.NotifyNewError("body not specified")
+		return
+	}
+	from, ok := params["from"].(string)
+	if !ok {
+		from = cfg.Message.From
+	}
+	if from == "" {
+		c.NotifyNewError("from not specified")
+		return
+	}
+	contentType, ok := params["content_type"].(string)
+	if !ok {
+		contentType = cfg.Message.ContentType
+	}
+	if contentType == "" {
+		contentType = default_message_content_type
+	}
+
+	var messageParams = map[string]string{
+		"method": "MESSAGE",
+		"ruri": to,
+		"headers": fmt.Sprintf(messageHeadersFormat, from, to, contentType, c.ID),
+		"body": body,
+	}
+	if next_hop := c.proxy.GetURI(); next_hop != "" {
+		messageParams["next_hop"] = next_hop
+	}
+
+	sm := &sendMessageCmd{
+		cmd: c,
+		to: to,
+	}
+	err := c.proxy.MICall("t_uac_dlg", &messageParams, sm.sendMessageReply)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+}
+
+type messageWatchCmd struct {
+	cmd *Cmd
+	to string
+	lock sync.Mutex
+	done bool
+	sub event.Subscription
+}
+
+func (mw *messageWatchCmd) messageWatchNotify(sub event.Subscription, notify *jsonrpc.JsonRPCNotification) {
+
+	to, err := notify.GetString("to")
+	if err != nil || (mw.to != "" && to != mw.to) {
+		return
+	}
+
+	data := map[string]interface{}{
+		"to": to,
+		"timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	/* besides the known ones, pass along whatever the script raised */
+	if params, ok := notify.Params.(map[string]interface{}); ok {
+		for name, value := range params {
+			data[name] = value
+		}
+	}
+
+	mw.lock.Lock()
+	defer mw.lock.Unlock()
+	if !mw.done {
+		mw.cmd.NotifyEvent("MessageReceived", data)
+	}
+}
+
+func (mw *messageWatchCmd) stop() {
+	mw.lock.Lock()
+	defer mw.lock.Unlock()
+
+	mw.done = true
+	mw.sub.Unsubscribe()
+	mw.cmd.NotifyEnd()
+}
+
+func (c *Cmd) MessageWatch(params map[string]interface{}) {
+
+	value, ok := params["duration"].(string)
+	if !ok {
+		c.NotifyNewError("duration not specified")
+		return
+	}
+	duration, err := strconv.Atoi(value)
+	if err != nil || duration <= 0 {
+		c.NotifyNewError("invalid duration " + value)
+		return
+	}
+
+	mw := &messageWatchCmd{
+		cmd: c,
+	}
+	var filter map[string]interface{}
+	if to, ok := params["to"].(string); ok {
+		mw.to = to
+		filter = map[string]interface{}{
+			"to": to,
+		}
+	}
+
+	name := default_message_event
+	if cfg := c.proxy.GetConfig(); cfg.Message.Event != "" {
+		name = cfg.Message.Event
+	}
+
+	mw.lock.Lock()
+	defer mw.lock.Unlock()
+
+	mw.sub = c.proxy.SubscribeFilter(name, mw.messageWatchNotify, filter)
+	if mw.sub == nil {
+		c.NotifyNewError("Could not subscribe for event")
+		return
+	}
+	c.NotifyEvent("MessageWatching", map[string]interface{}{
+		"duration": duration,
+	})
+	time.AfterFunc(time.Duration(duration) * time.Second, mw.stop)
+}
@@ -0,0 +1,160 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+)
+
+const (
+	originate_uri = "uri"
+	originate_media = "media"
+	originate_application = "application"
+)
+
+const originate_file_placeholder string = "{file}"
+const originate_application_placeholder string = "{application}"
+
+const default_amd_header string = "X-AMD"
+const default_amd_result_header string = "X-AMD-Result"
+
+/* the SIP URI the caller is connected to, for each type of target */
+func (c *Cmd) originateTarget(kind, target string) (string, error) {
+	cfg := c.proxy.GetConfig()
+
+	switch kind {
+	case originate_uri:
+		return target, nil
+	case originate_media:
+		if cfg.Originate.Media == "" {
+			return "", errors.New("media URI not configured")
+		}
+		return strings.Replace(cfg.Originate.Media, originate_file_placeholder, target, -1), nil
+	case originate_application:
+		if cfg.Originate.Application == "" {
+			return "", errors.New("application URI not configured")
+		}
+		return strings.Replace(cfg.Originate.Application, originate_application_placeholder, target, -1), nil
+	}
+	return "", errors.New("invalid type " + kind)
+}
+
+/* looks for a header in a SIP message */
+func sipHeader(message, name string) (string, bool) {
+	for _, header := range strings.Split(message, "\r\n") {
+		hdr := strings.SplitN(header, ":", 2)
+		if len(hdr) == 2 && strings.EqualFold(strings.TrimSpace(hdr[0]), name) {
+			return strings.TrimSpace(hdr[1]), true
+		}
+	}
+	return "", false
+}
+
+type originateCmd struct {
+	cs *callStartCmd
+	amdResultHeader string
+}
+
+/* reports the answering machine detection, then goes on like CallStart */
+func (oc *originateCmd) originateInitial(response *jsonrpc.JsonRPCResponse) {
+
+	if oc.amdResultHeader != "" && !response.IsError() {
+		message, _ := response.GetString("Message")
+		if result, ok := sipHeader(message, oc.amdResultHeader); ok {
+			oc.cs.cmd.NotifyEvent("AMDResult", map[string]interface{}{
+				"caller": oc.cs.caller,
+				"result": result,
+			})
+		}
+	}
+	oc.cs.callStartInitial(response)
+}
+
+func (c *Cmd) Originate(params map[string]interface{}) {
+
+	caller, ok := params["caller"].(string)
+	if !ok {
+		c.NotifyNewError("caller not specified")
+		return
+	}
+	target, ok := params["target"].(string)
+	if !ok {
+		c.NotifyNewError("target not specified")
+		return
+	}
+	kind, ok := params["type"].(string)
+	if !ok {
+		kind = originate_uri
+	}
+	callee, err := c.originateTarget(kind, target)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+	amd := false
+	if value, ok := params["amd"].(string); ok {
+		amd, err = strconv.ParseBool(value)
+		if err != nil {
+			c.NotifyNewError("invalid amd " + value)
+			return
+		}
+	}
+
+	oc := &originateCmd{
+		cs: &callStartCmd{
+			caller: caller,
+			callee: callee,
+			ruri: caller,
+			dlginfo: "",
+			cmd: c,
+		},
+	}
+	inviteParams := c.inviteParams(caller, caller, callee, c.ID)
+
+	/* hint the answering machine detection to the proxy, and look for its
+	 * verdict in the reply */
+	if amd {
+		cfg := c.proxy.GetConfig()
+		header := cfg.Originate.AMDHeader
+		if header == "" {
+			header = default_amd_header
+		}
+		oc.amdResultHeader = cfg.Originate.AMDResultHeader
+		if oc.amdResultHeader == "" {
+			oc.amdResultHeader = default_amd_result_header
+		}
+		(*inviteParams)["headers"] += header + ": early-media\r\n"
+	}
+
+	c.NotifyEvent("OriginateStart", map[string]interface{}{
+		"caller": caller,
+		"target": target,
+		"type": kind,
+		"callee": callee,
+	})
+
+	err = c.proxy.MICall("t_uac_dlg", inviteParams, oc.originateInitial)
+	if err != nil {
+		c.NotifyError(err)
+		return
+	}
+}
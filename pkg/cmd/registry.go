@@ -0,0 +1,323 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+)
+
+const (
+	StateRunning = "running"
+	StateEnded = "ended"
+	StateFailed = "failed"
+)
+
+// ErrCallbackURL - the callback_url parameter of a command was refused
+var ErrCallbackURL = errors.New("invalid callback_url")
+
+// RecordEvent - an event of a command, as reported to the clients
+type RecordEvent struct {
+	Seq uint64 `json:"seq"`
+	Time time.Time `json:"time"`
+	Event string `json:"event"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// Record - the state and event history of a command
+type Record struct {
+	ID string `json:"cmd_id"`
+	Command string `json:"method"`
+	Identity string `json:"identity,omitempty"`
+	CallbackURL string `json:"callback_url,omitempty"`
+	State string `json:"state"`
+	Started time.Time `json:"started"`
+	Ended *time.Time `json:"ended,omitempty"`
+	Events []*RecordEvent `json:"events"`
+}
+
+// Notification - an event of a command, along with the command it belongs to
+type Notification struct {
+	ID string
+	Command string
+	Identity string
+	CallbackURL string
+	*RecordEvent
+}
+
+// JsonRPC - builds the JSON-RPC notification sent to the clients
+func (n *Notification) JsonRPC() (*jsonrpc.JsonRPCNotification) {
+	body := map[string]interface{}{
+		"cmd_id": n.ID,
+		"event": n.Event,
+	}
+	if n.Data != nil {
+		body["data"] = n.Data
+	}
+	return jsonrpc.NewNotification(n.Command, body)
+}
+
+// TrackNotify - called for each event of a tracked command, the last one
+// being the "Ended" event
+type TrackNotify func(n *Notification)
+
+// ListenFilter - selects the notifications a listener is interested in
+type ListenFilter func(n *Notification) (bool)
+
+// the number of notifications a listener can fall behind before it is dropped
+const listener_backlog int = 256
+
+// Listener - receives the notifications of all the commands matching a filter
+type Listener struct {
+	C chan *Notification
+	filter ListenFilter
+	registry *Registry
+	closed bool
+}
+
+// Close - stops receiving notifications; the C channel is closed
+func (l *Listener) Close() {
+	l.registry.lock.Lock()
+	l.registry.removeListener(l)
+	l.registry.lock.Unlock()
+}
+
+// Registry - keeps track of all the commands running through the API
+type Registry struct {
+	lock sync.RWMutex
+	seq uint64
+	retention time.Duration
+	records map[string]*Record
+	listeners []*Listener
+	checkCallback func(url string) (error)
+}
+
+func NewRegistry(retention time.Duration) (*Registry) {
+	return &Registry{
+		retention: retention,
+		records: make(map[string]*Record),
+	}
+}
+
+func (r *Registry) removeListener(l *Listener) {
+	if l.closed {
+		return
+	}
+	for i, s := range r.listeners {
+		if s == l {
+			r.listeners = append(r.listeners[0:i], r.listeners[i+1:]...)
+			break
+		}
+	}
+	l.closed = true
+	close(l.C)
+}
+
+func (r *Registry) record(rec *Record, name string, data interface{}) (*Notification) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.seq++
+	event := &RecordEvent{
+		Seq: r.seq,
+		Time: time.Now(),
+		Event: name,
+		Data: data,
+	}
+	rec.Events = append(rec.Events, event)
+	switch name {
+	case "Error":
+		rec.State = StateFailed
+	case "Ended":
+		if rec.State == StateRunning {
+			rec.State = StateEnded
+		}
+		rec.Ended = &event.Time
+	}
+
+	n := &Notification{
+		ID: rec.ID,
+		Command: rec.Command,
+		Identity: rec.Identity,
+		CallbackURL: rec.CallbackURL,
+		RecordEvent: event,
+	}
+	for i := 0; i < len(r.listeners); i++ {
+		l := r.listeners[i]
+		if !l.filter(n) {
+			continue
+		}
+		select {
+		case l.C <- n:
+		default:
+			/* too slow - let it catch up by resuming from its last event */
+			logrus.Warn("dropping slow listener of command notifications")
+			r.removeListener(l)
+			i--
+		}
+	}
+	return n
+}
+
+func (r *Registry) expire(rec *Record) {
+	r.lock.Lock()
+	/* the cmd_id might have been reused in the meantime */
+	if r.records[rec.ID] == rec {
+		delete(r.records, rec.ID)
+	}
+	r.lock.Unlock()
+}
+
+// SetCallbackCheck - sets the check of the callback_url parameter of the
+// commands, done before they are accepted
+func (r *Registry) SetCallbackCheck(check func(url string) (error)) {
+	r.lock.Lock()
+	r.checkCallback = check
+	r.lock.Unlock()
+}
+
+// Track - registers a command that is about to run and consumes all its
+// events; must be called before the command is run, with its parameters
+func (r *Registry) Track(c *Cmd, identity string, params map[string]interface{}, fn TrackNotify) (error) {
+	var callback string
+
+	/* the events of the command are also posted to this URL */
+	if v, ok := params["callback_url"]; ok {
+		if callback, ok = v.(string); !ok {
+			return fmt.Errorf("%w: must be a string", ErrCallbackURL)
+		}
+		r.lock.Lock()
+		check := r.checkCallback
+		r.lock.Unlock()
+		if check != nil {
+			if err := check(callback); err != nil {
+				return fmt.Errorf("%w: %s", ErrCallbackURL, err)
+			}
+		}
+	}
+
+	r.lock.Lock()
+	if old, ok := r.records[c.ID]; ok && old.State == StateRunning {
+		r.lock.Unlock()
+		return errors.New("cmd_id " + c.ID + " already in use")
+	}
+	rec := &Record{
+		ID: c.ID,
+		Command: c.Command,
+		Identity: identity,
+		State: StateRunning,
+		Started: time.Now(),
+		CallbackURL: callback,
+		Events: make([]*RecordEvent, 0),
+	}
+	r.records[c.ID] = rec
+	r.lock.Unlock()
+	c.identity = identity
+
+	go func() {
+		var n *Notification
+
+		for event := range c.Wait() {
+			if event.IsError() {
+				n = r.record(rec, "Error", event.Error.Error())
+			} else {
+				n = r.record(rec, event.Name, event.Params)
+			}
+			if fn != nil {
+				fn(n)
+			}
+		}
+
+		logrus.Debugf("done reading events for cmd %s (%s)", c.Command, c.ID)
+		if c.started.IsZero() {
+			/* the command was refused, there is nothing to keep */
+			r.expire(rec)
+			return
+		}
+		n = r.record(rec, "Ended", nil)
+		if fn != nil {
+			fn(n)
+		}
+		time.AfterFunc(r.retention, func() { r.expire(rec) })
+	}()
+	return nil
+}
+
+// ListenLive - listens only for new notifications, without replaying any
+const ListenLive = ^uint64(0)
+
+// Listen - receives the notifications matching the filter; the ones that
+// are still retained and are newer than the since sequence are replayed first
+func (r *Registry) Listen(since uint64, filter ListenFilter) (*Listener) {
+	var replay []*Notification
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if since != ListenLive {
+		for _, rec := range r.records {
+			for _, event := range rec.Events {
+				n := &Notification{
+					ID: rec.ID,
+					Command: rec.Command,
+					Identity: rec.Identity,
+					CallbackURL: rec.CallbackURL,
+					RecordEvent: event,
+				}
+				if event.Seq > since && filter(n) {
+					replay = append(replay, n)
+				}
+			}
+		}
+		sort.Slice(replay, func(i, j int) bool {
+			return replay[i].Seq < replay[j].Seq
+		})
+	}
+
+	l := &Listener{
+		C: make(chan *Notification, listener_backlog + len(replay)),
+		filter: filter,
+		registry: r,
+	}
+	for _, n := range replay {
+		l.C <- n
+	}
+	r.listeners = append(r.listeners, l)
+	return l
+}
+
+// Get - returns a snapshot of a command's record
+func (r *Registry) Get(id string) (*Record) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	rec, ok := r.records[id]
+	if !ok {
+		return nil
+	}
+	snapshot := *rec
+	snapshot.Events = make([]*RecordEvent, len(rec.Events))
+	copy(snapshot.Events, rec.Events)
+	return &snapshot
+}
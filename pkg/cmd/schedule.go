@@ -0,0 +1,372 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/OpenSIPS/call-api/pkg/config"
+	"github.com/OpenSIPS/call-api/pkg/proxy"
+)
+
+/* how long to wait before starting a due call again, when the proxy could
+ * not be reached */
+const schedule_retry time.Duration = 30 * time.Second
+
+/* the MI command the proxy is probed with before a call is started, unless
+ * the one of the health checks is configured */
+const default_schedule_probe string = "uptime"
+
+// ScheduledCall - a CallStart command that is run later
+type ScheduledCall struct {
+	ID string `json:"schedule_id"`
+	At time.Time `json:"at"`
+	Identity string `json:"identity,omitempty"`
+	Params map[string]interface{} `json:"params"`
+}
+
+func (sc *ScheduledCall) summary() (map[string]interface{}) {
+	return map[string]interface{}{
+		"schedule_id": sc.ID,
+		"at": sc.At,
+		"caller": sc.Params["caller"],
+		"callee": sc.Params["callee"],
+	}
+}
+
+// Scheduler - keeps the scheduled calls, and starts them when they are due;
+// the calls run as commands of the registry, their cmd_id being the
+// schedule_id, on behalf of the identity that scheduled them
+type Scheduler struct {
+	cfg *config.Config
+	store string
+	registry *Registry
+
+	lock sync.Mutex
+	calls map[string]*ScheduledCall
+	timers map[string]*time.Timer
+	proxy *proxy.Proxy
+}
+
+/* the scheduler used by the scheduling commands, if any */
+var scheduler *Scheduler
+
+func SetScheduler(s *Scheduler) {
+	scheduler = s
+}
+
+func NewScheduler(cfg *config.Config, registry *Registry) (*Scheduler) {
+	s := &Scheduler{
+		cfg: cfg,
+		store: cfg.Commands.ScheduleStore,
+		registry: registry,
+		calls: make(map[string]*ScheduledCall),
+		timers: make(map[string]*time.Timer),
+	}
+	if s.store == "" {
+		return s
+	}
+
+	data, err := ioutil.ReadFile(s.store)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Errorf("could not read scheduled calls: %s", err)
+		}
+		return s
+	}
+	var calls []*ScheduledCall
+	if err = json.Unmarshal(data, &calls); err != nil {
+		logrus.Errorf("could not parse scheduled calls: %s", err)
+		return s
+	}
+	for _, sc := range calls {
+		s.calls[sc.ID] = sc
+	}
+	logrus.Infof("loaded %d scheduled call(s)", len(calls))
+	return s
+}
+
+// Start - arms the loaded calls; the ones missed while down are started now
+func (s *Scheduler) Start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, sc := range s.calls {
+		s.arm(sc)
+	}
+}
+
+/* must be called with the scheduler locked */
+func (s *Scheduler) arm(sc *ScheduledCall) {
+	id := sc.ID
+	s.timers[id] = time.AfterFunc(time.Until(sc.At), func() { s.fire(id) })
+}
+
+/* must be called with the scheduler locked */
+func (s *Scheduler) save() (error) {
+	if s.store == "" {
+		return nil
+	}
+
+	calls := make([]*ScheduledCall, 0, len(s.calls))
+	for _, sc := range s.calls {
+		calls = append(calls, sc)
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		return calls[i].At.Before(calls[j].At)
+	})
+	data, err := json.MarshalIndent(calls, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	/* replace the store at once, so it is never left half written */
+	tmp := s.store + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.store)
+}
+
+func (s *Scheduler) getProxy() (*proxy.Proxy) {
+	if s.proxy == nil {
+		s.proxy = proxy.NewProxy(s.cfg)
+	}
+	return s.proxy
+}
+
+/* checks that the proxy answers MI commands */
+func (s *Scheduler) probe(p *proxy.Proxy) (error) {
+	if p == nil {
+		return errors.New("could not initialize SIP proxy")
+	}
+	command := default_schedule_probe
+	if s.cfg.Health.MICommand != "" {
+		command = s.cfg.Health.MICommand
+	}
+	/* even an error reply means the proxy is up */
+	if _, err := p.MICallSync(command, nil); err != nil {
+		return errors.New("proxy unreachable: " + err.Error())
+	}
+	return nil
+}
+
+func (s *Scheduler) fire(id string) {
+
+	s.lock.Lock()
+	_, ok := s.calls[id]
+	p := s.getProxy()
+	s.lock.Unlock()
+	if !ok {
+		return
+	}
+
+	err := s.probe(p)
+
+	s.lock.Lock()
+	sc, ok := s.calls[id]
+	if !ok {
+		/* cancelled meanwhile */
+		s.lock.Unlock()
+		return
+	}
+	if err != nil {
+		/* the call is kept, and started once the proxy can be reached */
+		logrus.Errorf("could not start scheduled call %s: %s, retrying in %s",
+			id, err, schedule_retry)
+		s.timers[id] = time.AfterFunc(schedule_retry, func() { s.fire(id) })
+		s.lock.Unlock()
+		return
+	}
+	delete(s.calls, id)
+	delete(s.timers, id)
+	if err := s.save(); err != nil {
+		logrus.Errorf("could not store scheduled calls: %s", err)
+	}
+	s.lock.Unlock()
+
+	c := New("CallStart", sc.ID, p)
+	if err := s.registry.Track(c, sc.Identity, sc.Params, nil); err != nil {
+		logrus.Errorf("could not start scheduled call %s: %s", id, err)
+		return
+	}
+	if err := c.Run(sc.Params); err != nil {
+		logrus.Errorf("could not start scheduled call %s: %s", id, err)
+		return
+	}
+	logrus.Infof("started scheduled call %s (due at %s)", id, sc.At.Format(time.RFC3339))
+}
+
+// Add - schedules a new call
+func (s *Scheduler) Add(sc *ScheduledCall) (error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.calls[sc.ID] = sc
+	if err := s.save(); err != nil {
+		delete(s.calls, sc.ID)
+		return err
+	}
+	s.arm(sc)
+	return nil
+}
+
+// Cancel - drops a scheduled call, if visible to the identity
+func (s *Scheduler) Cancel(id, identity string) (error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sc, ok := s.calls[id]
+	if !ok || (identity != "" && identity != sc.Identity) {
+		return errors.New("unknown schedule_id " + id)
+	}
+	s.timers[id].Stop()
+	delete(s.calls, id)
+	delete(s.timers, id)
+	return s.save()
+}
+
+// List - the scheduled calls visible to the identity, the earliest first
+func (s *Scheduler) List(identity string) ([]*ScheduledCall) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	calls := make([]*ScheduledCall, 0)
+	for _, sc := range s.calls {
+		if identity == "" || identity == sc.Identity {
+			calls = append(calls, sc)
+		}
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		return calls[i].At.Before(calls[j].At)
+	})
+	return calls
+}
+
+func (c *Cmd) CallSchedule(params map[string]interface{}) {
+	var at time.Time
+	var err error
+
+	if scheduler == nil {
+		c.NotifyNewError("call scheduling is not available")
+		return
+	}
+
+	caller, ok := params["caller"].(string)
+	if !ok {
+		c.NotifyNewError("caller not specified")
+		return
+	}
+	callee, ok := params["callee"].(string)
+	if !ok {
+		c.NotifyNewError("callee not specified")
+		return
+	}
+
+	if value, ok := params["at"].(string); ok {
+		at, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.NotifyNewError("invalid at " + value)
+			return
+		}
+	} else if value, ok := params["delay"].(string); ok {
+		delay, err := strconv.Atoi(value)
+		if err != nil || delay < 0 {
+			c.NotifyNewError("invalid delay " + value)
+			return
+		}
+		at = time.Now().Add(time.Duration(delay) * time.Second)
+	} else {
+		c.NotifyNewError("at not specified")
+		return
+	}
+	if at.Before(time.Now()) {
+		c.NotifyNewError("at is in the past")
+		return
+	}
+
+	/* the parameters of the CallStart command */
+	callParams := map[string]interface{}{
+		"caller": caller,
+		"callee": callee,
+	}
+	if url, ok := params["callback_url"].(string); ok {
+		callParams["callback_url"] = url
+	}
+
+	sc := &ScheduledCall{
+		ID: uuid.New().String(),
+		At: at,
+		Identity: c.identity,
+		Params: callParams,
+	}
+	if err = scheduler.Add(sc); err != nil {
+		c.NotifyError(err)
+		return
+	}
+	c.NotifyEvent("CallScheduled", sc.summary())
+	c.NotifyEnd()
+}
+
+func (c *Cmd) CallScheduleList(params map[string]interface{}) {
+
+	if scheduler == nil {
+		c.NotifyNewError("call scheduling is not available")
+		return
+	}
+
+	calls := make([]interface{}, 0)
+	for _, sc := range scheduler.List(c.identity) {
+		calls = append(calls, sc.summary())
+	}
+	c.NotifyEvent("ScheduledCalls", map[string]interface{}{
+		"calls": calls,
+	})
+	c.NotifyEnd()
+}
+
+func (c *Cmd) CallScheduleCancel(params map[string]interface{}) {
+
+	if scheduler == nil {
+		c.NotifyNewError("call scheduling is not available")
+		return
+	}
+
+	id, ok := params["schedule_id"].(string)
+	if !ok {
+		c.NotifyNewError("schedule_id not specified")
+		return
+	}
+	if err := scheduler.Cancel(id, c.identity); err != nil {
+		c.NotifyError(err)
+		return
+	}
+	c.NotifyEvent("CallScheduleCancelled", map[string]interface{}{
+		"schedule_id": id,
+	})
+	c.NotifyEnd()
+}
@@ -0,0 +1,476 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/OpenSIPS/call-api/pkg/event"
+	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+)
+
+const (
+	consult_starting = iota
+	consult_talking /* the agent talks to the target, the customer is held */
+	consult_swapped /* the agent talks to the customer, the target is held */
+	consult_busy /* a step is in progress */
+	consult_done
+)
+
+// consultation - an agent consulting a target before transferring the
+// customer to it, owned by the TransferConsult command
+type consultation struct {
+	cmd *Cmd
+	callid, leg string /* the customer's call, and the agent's leg in it */
+	agent, destination string
+	ccallid string /* the agent's call to the target */
+	lock sync.Mutex
+	state int
+	completing bool
+	customerHeld, targetHeld bool
+	callSub, consultSub, transferSub event.Subscription
+}
+
+var consultationsLock sync.Mutex
+var consultations = make(map[string]*consultation)
+
+func getConsultation(id string) (*consultation) {
+	consultationsLock.Lock()
+	defer consultationsLock.Unlock()
+	return consultations[id]
+}
+
+func (ct *consultation) body() (map[string]interface{}) {
+	body := map[string]interface{}{
+		"transfer_id": ct.cmd.ID,
+		"callid": ct.callid,
+		"destination": ct.destination,
+	}
+	if ct.ccallid != "" {
+		body["consult_callid"] = ct.ccallid
+	}
+	return body
+}
+
+/* runs a call command on one of the calls, and waits for it to complete */
+func (ct *consultation) callCommand(command, callid string) (error) {
+	return New(command, "", ct.cmd.proxy).RunSync(map[string]interface{}{
+		"callid": callid,
+	})
+}
+
+func endDialog(c *Cmd, callid string) {
+	var byeParams = map[string]string{
+		"dialog_id": callid,
+	}
+	c.proxy.MICall("dlg_end_dlg", &byeParams, nil)
+}
+
+/* must be called with the consultation locked */
+func (ct *consultation) finish(name string, body map[string]interface{}, err error) {
+	ct.state = consult_done
+
+	consultationsLock.Lock()
+	delete(consultations, ct.cmd.ID)
+	consultationsLock.Unlock()
+
+	for _, sub := range []event.Subscription{ct.callSub, ct.consultSub, ct.transferSub} {
+		if sub != nil {
+			sub.Unsubscribe()
+		}
+	}
+	if err != nil {
+		ct.cmd.NotifyError(err)
+		return
+	}
+	ct.cmd.NotifyEvent(name, body)
+	ct.cmd.NotifyEnd()
+}
+
+/* must be called with the consultation locked; takes the customer off
+ * hold, if needed */
+func (ct *consultation) resume() (error) {
+	if !ct.customerHeld {
+		return nil
+	}
+	if err := ct.callCommand("CallUnhold", ct.callid); err != nil {
+		return err
+	}
+	ct.customerHeld = false
+	return nil
+}
+
+/* must be called with the consultation locked; reports a customer left on
+ * hold in the final event */
+func (ct *consultation) resumeBody(body map[string]interface{}) {
+	if err := ct.resume(); err != nil {
+		body["unhold_error"] = err.Error()
+	}
+}
+
+/* gives the customer back to the agent, after the consultation failed */
+func (ct *consultation) abort(err error) {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	/* the customer hung up meanwhile */
+	if ct.state == consult_done {
+		return
+	}
+	if ct.ccallid != "" {
+		endDialog(ct.cmd, ct.ccallid)
+	}
+	if uerr := ct.resume(); uerr != nil {
+		err = fmt.Errorf("%s (could not take the customer off hold: %s)", err, uerr)
+	}
+	ct.finish("", nil, err)
+}
+
+func (ct *consultation) dlgNotify(sub event.Subscription, notify *jsonrpc.JsonRPCNotification) {
+
+	state, err := notify.Get("new_state")
+	if err != nil || fmt.Sprint(state) != dlg_state_deleted {
+		return
+	}
+	callid, _ := notify.GetString("callid")
+
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	/* both calls end as the transfer completes */
+	if ct.state == consult_done || ct.completing {
+		return
+	}
+
+	body := ct.body()
+	if callid == ct.callid {
+		/* the customer hung up - there is nobody to transfer; a target
+		 * still ringing is hung up by start() once answered */
+		if ct.ccallid != "" {
+			endDialog(ct.cmd, ct.ccallid)
+		}
+		body["reason"] = "customer hung up"
+	} else {
+		body["reason"] = "target hung up"
+		ct.resumeBody(body)
+	}
+	ct.finish("ConsultEnded", body, nil)
+}
+
+func (ct *consultation) start() {
+
+	/* the customer might hang up while the target is still ringing */
+	var callFilter = map[string]interface{}{
+		"callid": ct.callid,
+	}
+	ct.lock.Lock()
+	ct.callSub = ct.cmd.proxy.SubscribeFilter("E_DLG_STATE_CHANGED", ct.dlgNotify, callFilter)
+	ct.lock.Unlock()
+	if ct.callSub == nil {
+		ct.abort(errors.New("Could not subscribe for event"))
+		return
+	}
+
+	err := ct.callCommand("CallHold", ct.callid)
+	if err != nil {
+		ct.abort(err)
+		return
+	}
+	ct.lock.Lock()
+	if ct.state == consult_done {
+		ct.lock.Unlock()
+		return
+	}
+	ct.customerHeld = true
+	ct.cmd.NotifyEvent("CustomerHeld", ct.body())
+	ct.lock.Unlock()
+
+	/* the agent is called just like CallStart does */
+	cs := New("CallStart", "", ct.cmd.proxy)
+	err = cs.Run(map[string]interface{}{
+		"caller": ct.agent,
+		"callee": ct.destination,
+	})
+	if err != nil {
+		ct.abort(err)
+		return
+	}
+	var ccallid string
+	for ev := range cs.Wait() {
+		if ev.IsError() {
+			err = ev.Error
+		} else if ev.Name == "CalleeAnswered" {
+			body, _ := ev.Params.(map[string]interface{})
+			ccallid, _ = body["callid"].(string)
+		}
+	}
+	if err == nil && ccallid == "" {
+		err = errors.New("consultation call ended before being answered")
+	}
+	if err != nil {
+		ct.abort(err)
+		return
+	}
+
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	if ct.state == consult_done {
+		/* the customer hung up while the target was ringing */
+		endDialog(ct.cmd, ccallid)
+		return
+	}
+	ct.ccallid = ccallid
+	var consultFilter = map[string]interface{}{
+		"callid": ct.ccallid,
+	}
+	ct.consultSub = ct.cmd.proxy.SubscribeFilter("E_DLG_STATE_CHANGED", ct.dlgNotify, consultFilter)
+	if ct.consultSub == nil {
+		endDialog(ct.cmd, ct.ccallid)
+		err = errors.New("Could not subscribe for event")
+		if uerr := ct.resume(); uerr != nil {
+			err = fmt.Errorf("%s (could not take the customer off hold: %s)", err, uerr)
+		}
+		ct.finish("", nil, err)
+		return
+	}
+	ct.state = consult_talking
+	ct.cmd.NotifyEvent("ConsultAnswered", ct.body())
+}
+
+func (ct *consultation) transferNotify(sub event.Subscription, notify *jsonrpc.JsonRPCNotification) {
+
+	state, err := notify.GetString("state")
+	if err != nil {
+		return
+	}
+	status, _ := notify.GetString("status")
+
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	if !ct.completing {
+		return
+	}
+
+	switch state {
+	case "failure":
+		ct.transferSub.Unsubscribe()
+		ct.transferSub = nil
+		ct.completing = false
+		ct.state = consult_talking
+		if ct.targetHeld {
+			ct.state = consult_swapped
+		}
+		body := ct.body()
+		body["status"] = status
+		ct.cmd.NotifyEvent("TransferCompleteFailed", body)
+	case "ok":
+		/* the customer is now talking to the target */
+		endDialog(ct.cmd, ct.callid)
+		ct.finish("TransferCompleted", ct.body(), nil)
+	}
+}
+
+/* must be called with the consultation locked */
+func (ct *consultation) complete() (error) {
+
+	var transferFilter = map[string]interface{}{
+		"callid": ct.callid,
+	}
+	ct.transferSub = ct.cmd.proxy.SubscribeFilter("E_CALL_TRANSFER", ct.transferNotify, transferFilter)
+	if ct.transferSub == nil {
+		return errors.New("Could not subscribe for event")
+	}
+
+	/* the customer replaces the agent in the consultation call */
+	var transferParams = map[string]string{
+		"callid": ct.callid,
+		"leg": otherLeg(ct.leg),
+		"transfer_callid": ct.ccallid,
+		"transfer_leg": "callee",
+	}
+	ret, err := ct.cmd.proxy.MICallSync("call_transfer", &transferParams)
+	if err == nil && ret.IsError() {
+		err = ret.Error
+	}
+	if err != nil {
+		ct.transferSub.Unsubscribe()
+		ct.transferSub = nil
+		return err
+	}
+	ct.state = consult_busy
+	ct.completing = true
+	ct.cmd.NotifyEvent("TransferCompleting", ct.body())
+	return nil
+}
+
+/* must be called with the consultation locked */
+func (ct *consultation) cancel() {
+	endDialog(ct.cmd, ct.ccallid)
+	body := ct.body()
+	ct.resumeBody(body)
+	ct.finish("TransferCancelled", body, nil)
+}
+
+/* puts on hold the party the agent talks to, and resumes the other one */
+func (ct *consultation) swap() (error) {
+	var err error
+
+	held, resumed, active := ct.ccallid, ct.callid, "customer"
+	if ct.state == consult_swapped {
+		held, resumed, active = ct.callid, ct.ccallid, "target"
+	}
+	previous := ct.state
+	ct.state = consult_busy
+
+	/* the events of the calls must go through while switching */
+	ct.lock.Unlock()
+	if err = ct.callCommand("CallHold", held); err == nil {
+		err = ct.callCommand("CallUnhold", resumed)
+	}
+	ct.lock.Lock()
+
+	if ct.state == consult_done {
+		return errors.New("consultation ended while swapping")
+	}
+	if err != nil {
+		ct.state = previous
+		return err
+	}
+	if previous == consult_talking {
+		ct.state = consult_swapped
+		ct.customerHeld, ct.targetHeld = false, true
+	} else {
+		ct.state = consult_talking
+		ct.customerHeld, ct.targetHeld = true, false
+	}
+	body := ct.body()
+	body["active"] = active
+	ct.cmd.NotifyEvent("PartiesSwapped", body)
+	return nil
+}
+
+func (c *Cmd) TransferConsult(params map[string]interface{}) {
+	var err error
+
+	callid, ok := params["callid"].(string)
+	if !ok {
+		c.NotifyNewError("callid not specified")
+		return
+	}
+	leg, ok := params["leg"].(string)
+	if !ok {
+		c.NotifyNewError("leg not specified")
+		return
+	}
+	if !validLeg(leg) {
+		c.NotifyNewError("invalid leg " + leg)
+		return
+	}
+	destination, ok := params["destination"].(string)
+	if !ok {
+		c.NotifyNewError("destination not specified")
+		return
+	}
+	agent, ok := params["agent"].(string)
+	if !ok {
+		agent, err = dialogParty(c, callid, leg)
+		if err != nil {
+			c.NotifyError(err)
+			return
+		}
+	}
+
+	ct := &consultation{
+		cmd: c,
+		callid: callid,
+		leg: leg,
+		agent: agent,
+		destination: destination,
+	}
+	consultationsLock.Lock()
+	for _, o := range consultations {
+		if o.callid == callid {
+			consultationsLock.Unlock()
+			c.NotifyNewError("call " + callid + " is already in a consultation")
+			return
+		}
+	}
+	consultations[c.ID] = ct
+	consultationsLock.Unlock()
+
+	body := ct.body()
+	body["agent"] = agent
+	c.NotifyEvent("ConsultStarting", body)
+	ct.start()
+}
+
+/* runs a step of a consultation, on behalf of c */
+func (c *Cmd) consultControl(params map[string]interface{}, step func(ct *consultation) (error)) {
+
+	id, ok := params["transfer_id"].(string)
+	if !ok {
+		c.NotifyNewError("transfer_id not specified")
+		return
+	}
+	ct := getConsultation(id)
+	if ct == nil || !c.owns(ct.cmd) {
+		c.NotifyNewError("unknown transfer " + id)
+		return
+	}
+
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+
+	switch ct.state {
+	case consult_talking, consult_swapped:
+	case consult_done:
+		c.NotifyNewError("transfer " + id + " has ended")
+		return
+	default:
+		c.NotifyNewError("transfer " + id + " is busy")
+		return
+	}
+	if err := step(ct); err != nil {
+		c.NotifyError(err)
+		return
+	}
+	c.NotifyEnd()
+}
+
+func (c *Cmd) TransferComplete(params map[string]interface{}) {
+	c.consultControl(params, func(ct *consultation) (error) {
+		return ct.complete()
+	})
+}
+
+func (c *Cmd) TransferCancel(params map[string]interface{}) {
+	c.consultControl(params, func(ct *consultation) (error) {
+		ct.cancel()
+		return nil
+	})
+}
+
+func (c *Cmd) TransferSwap(params map[string]interface{}) {
+	c.consultControl(params, func(ct *consultation) (error) {
+		return ct.swap()
+	})
+}
@@ -0,0 +1,276 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package cmd
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenSIPS/call-api/pkg/event"
+	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+)
+
+const default_location_table string = "location"
+
+/* the usrloc events, and the event of the command reporting them */
+var contactEvents = map[string]string{
+	"E_UL_CONTACT_INSERT": "ContactInserted",
+	"E_UL_CONTACT_UPDATE": "ContactUpdated",
+	"E_UL_CONTACT_DELETE": "ContactDeleted",
+}
+
+func (c *Cmd) locationTable() (string) {
+	if table := c.proxy.GetConfig().Location.Table; table != "" {
+		return table
+	}
+	return default_location_table
+}
+
+/* the AOR of a SIP URI, as usrloc stores it */
+func (c *Cmd) locationAOR(uri string) (string) {
+	aor := uri
+	if i := strings.Index(aor, ":"); i >= 0 {
+		aor = aor[i+1:]
+	}
+	if i := strings.IndexAny(aor, ";?>"); i >= 0 {
+		aor = aor[:i]
+	}
+	if !c.proxy.GetConfig().Location.UseDomain {
+		if i := strings.Index(aor, "@"); i >= 0 {
+			aor = aor[:i]
+		}
+	}
+	return aor
+}
+
+/* the details of a usrloc contact that are reported */
+func contactInfo(contact map[string]interface{}) (map[string]interface{}) {
+	info := map[string]interface{}{
+		"uri": contact["Contact"],
+		"expires": contact["Expires"],
+		"socket": contact["Socket"],
+	}
+	if ua, ok := contact["User-agent"]; ok {
+		info["user_agent"] = ua
+	}
+	if received, ok := contact["Received"]; ok {
+		info["received"] = received
+	}
+	return info
+}
+
+func contactList(contacts interface{}) ([]interface{}) {
+	list := make([]interface{}, 0)
+	all, _ := contacts.([]interface{})
+	for _, ct := range all {
+		if contact, ok := ct.(map[string]interface{}); ok {
+			list = append(list, contactInfo(contact))
+		}
+	}
+	return list
+}
+
+/* the contacts registered for an AOR - none if the AOR is not found */
+func (c *Cmd) lookupContacts(aor string) ([]interface{}, error) {
+
+	var showParams = map[string]string{
+		"table_name": c.locationTable(),
+		"aor": aor,
+	}
+	ret, err := c.proxy.MICallSync("ul_show_contact", &showParams)
+	if err != nil {
+		return nil, err
+	}
+	if ret.IsError() {
+		if ret.Error.Code == 404 {
+			return make([]interface{}, 0), nil
+		}
+		return nil, ret.Error
+	}
+	result, _ := ret.Result.(map[string]interface{})
+	return contactList(result["Contacts"]), nil
+}
+
+/* all the AORs registered in the table, with their contacts */
+func (c *Cmd) dumpContacts() (map[string][]interface{}, error) {
+
+	ret, err := c.proxy.MICallSync("ul_dump", nil)
+	if err != nil {
+		return nil, err
+	}
+	if ret.IsError() {
+		return nil, ret.Error
+	}
+
+	aors := make(map[string][]interface{})
+	table := c.locationTable()
+	result, _ := ret.Result.(map[string]interface{})
+	domains, _ := result["Domains"].([]interface{})
+	for _, d := range domains {
+		domain, _ := d.(map[string]interface{})
+		if name, _ := domain["name"].(string); name != table {
+			continue
+		}
+		records, _ := domain["AORs"].([]interface{})
+		for _, r := range records {
+			record, _ := r.(map[string]interface{})
+			aor, ok := record["AOR"].(string)
+			if ok {
+				aors[aor] = contactList(record["Contacts"])
+			}
+		}
+	}
+	return aors, nil
+}
+
+type userLocationWatch struct {
+	cmd *Cmd
+	aor string
+	lock sync.Mutex
+	done bool
+	subs []event.Subscription
+}
+
+func (uw *userLocationWatch) notify(sub event.Subscription, notify *jsonrpc.JsonRPCNotification) {
+
+	name, ok := contactEvents[notify.Method]
+	if !ok {
+		return
+	}
+	aor, err := notify.GetString("aor")
+	if err != nil || (uw.aor != "" && aor != uw.aor) {
+		return
+	}
+
+	body := map[string]interface{}{
+		"aor": aor,
+	}
+	if uri, err := notify.Get("address"); err == nil {
+		body["uri"] = uri
+	}
+	for _, param := range []string{"expires", "socket", "received", "user_agent"} {
+		if value, err := notify.Get(param); err == nil {
+			body[param] = value
+		}
+	}
+
+	uw.lock.Lock()
+	defer uw.lock.Unlock()
+	if !uw.done {
+		uw.cmd.NotifyEvent(name, body)
+	}
+}
+
+func (uw *userLocationWatch) stop() {
+	uw.lock.Lock()
+	defer uw.lock.Unlock()
+
+	uw.done = true
+	for _, sub := range uw.subs {
+		sub.Unsubscribe()
+	}
+	uw.cmd.NotifyEnd()
+}
+
+func (c *Cmd) UserLocation(params map[string]interface{}) {
+	var watch time.Duration
+
+	if value, ok := params["watch"].(string); ok {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			c.NotifyNewError("invalid watch " + value)
+			return
+		}
+		watch = time.Duration(seconds) * time.Second
+	}
+
+	aor := ""
+	if uri, ok := params["aor"].(string); ok {
+		aor = c.locationAOR(uri)
+	}
+
+	uw := &userLocationWatch{
+		cmd: c,
+		aor: aor,
+	}
+
+	/* subscribe before looking up, so no change is missed */
+	if watch != 0 {
+		var filter map[string]interface{}
+		if aor != "" {
+			filter = map[string]interface{}{
+				"aor": aor,
+			}
+		}
+		for name := range contactEvents {
+			sub := c.proxy.SubscribeFilter(name, uw.notify, filter)
+			if sub == nil {
+				for _, s := range uw.subs {
+					s.Unsubscribe()
+				}
+				c.NotifyNewError("Could not subscribe for event")
+				return
+			}
+			uw.subs = append(uw.subs, sub)
+		}
+	}
+
+	uw.lock.Lock()
+	if aor != "" {
+		contacts, err := c.lookupContacts(aor)
+		if err != nil {
+			uw.done = true
+			uw.lock.Unlock()
+			for _, s := range uw.subs {
+				s.Unsubscribe()
+			}
+			c.NotifyError(err)
+			return
+		}
+		c.NotifyEvent("UserLocation", map[string]interface{}{
+			"aor": aor,
+			"contacts": contacts,
+		})
+	} else {
+		aors, err := c.dumpContacts()
+		if err != nil {
+			uw.done = true
+			uw.lock.Unlock()
+			for _, s := range uw.subs {
+				s.Unsubscribe()
+			}
+			c.NotifyError(err)
+			return
+		}
+		for aor, contacts := range aors {
+			c.NotifyEvent("UserLocation", map[string]interface{}{
+				"aor": aor,
+				"contacts": contacts,
+			})
+		}
+	}
+	uw.lock.Unlock()
+
+	if watch == 0 {
+		c.NotifyEnd()
+		return
+	}
+	time.AfterFunc(watch, uw.stop)
+}
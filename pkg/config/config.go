@@ -37,20 +37,116 @@ type Config struct {
 		Host string `yaml:"host,omitempty"`
 		Port int `yaml:"port,omitempty"`
 		Path string `yaml:"http_path,omitempty"`
+		MetricsPath string `yaml:"metrics_path,omitempty"`
 	} `yaml:"ws_server"`
 
 	Log struct {
-		FilePath string `yaml:"file_path",omitempty"`
-		Level string `yaml:"level",omitempty"`
+		FilePath string `yaml:"file_path,omitempty"`
+		Level string `yaml:"level,omitempty"`
 	} `yaml:"log"`
 
 	SIP struct {
-		URI string `yaml:"uri",omitempty"`
+		URI string `yaml:"uri,omitempty"`
 	} `yaml:"sip"`
 
 	MI struct {
 		URL string `yaml:"url,omitempty"`
 	} `yaml:"mi"`
+
+	Media struct {
+		Relay string `yaml:"relay,omitempty"`
+		Recording string `yaml:"recording,omitempty"`
+		Conference string `yaml:"conference,omitempty"`
+		Monitor string `yaml:"monitor,omitempty"`
+		MonitorDigits struct {
+			Listen string `yaml:"listen,omitempty"`
+			WhisperCaller string `yaml:"whisper_caller,omitempty"`
+			WhisperCallee string `yaml:"whisper_callee,omitempty"`
+			Barge string `yaml:"barge,omitempty"`
+		} `yaml:"monitor_digits"`
+	} `yaml:"media"`
+
+	DTMF struct {
+		Method string `yaml:"method,omitempty"`
+		Duration int `yaml:"duration,omitempty"`
+		Interval int `yaml:"interval,omitempty"`
+		Event string `yaml:"event,omitempty"`
+	} `yaml:"dtmf"`
+
+	Location struct {
+		Table string `yaml:"table,omitempty"`
+		UseDomain bool `yaml:"use_domain,omitempty"`
+	} `yaml:"location"`
+
+	Message struct {
+		From string `yaml:"from,omitempty"`
+		ContentType string `yaml:"content_type,omitempty"`
+		Event string `yaml:"event,omitempty"`
+	} `yaml:"message"`
+
+	Redirect struct {
+		TransactionValue string `yaml:"transaction_value,omitempty"`
+	} `yaml:"redirect"`
+
+	Forward struct {
+		CacheSystem string `yaml:"cache_system,omitempty"`
+		KeyPrefix string `yaml:"key_prefix,omitempty"`
+	} `yaml:"forward"`
+
+	Pickup struct {
+		Profile string `yaml:"profile,omitempty"`
+	} `yaml:"pickup"`
+
+	Originate struct {
+		Media string `yaml:"media,omitempty"`
+		Application string `yaml:"application,omitempty"`
+		AMDHeader string `yaml:"amd_header,omitempty"`
+		AMDResultHeader string `yaml:"amd_result_header,omitempty"`
+	} `yaml:"originate"`
+
+	Park struct {
+		URI string `yaml:"uri,omitempty"`
+		Slots int `yaml:"slots,omitempty"`
+		Timeout int `yaml:"timeout,omitempty"`
+	} `yaml:"park"`
+
+	Auth struct {
+		Tokens []struct {
+			Token string `yaml:"token"`
+			Identity string `yaml:"identity,omitempty"`
+			Methods []string `yaml:"methods,omitempty"`
+			Events []string `yaml:"events,omitempty"`
+		} `yaml:"tokens,omitempty"`
+	} `yaml:"auth"`
+
+	Commands struct {
+		Retention int `yaml:"retention,omitempty"`
+		ScheduleStore string `yaml:"schedule_store,omitempty"`
+	} `yaml:"commands"`
+
+	Webhooks struct {
+		Secret string `yaml:"secret,omitempty"`
+		Timeout int `yaml:"timeout,omitempty"`
+		Retries *int `yaml:"retries,omitempty"`
+		Backoff int `yaml:"backoff,omitempty"`
+		MaxBackoff int `yaml:"max_backoff,omitempty"`
+		Concurrency int `yaml:"concurrency,omitempty"`
+		DeadLetter string `yaml:"dead_letter,omitempty"`
+		AllowedHosts []string `yaml:"allowed_hosts,omitempty"`
+		Rules []struct {
+			URL string `yaml:"url"`
+			Methods []string `yaml:"methods,omitempty"`
+			Events []string `yaml:"events,omitempty"`
+		} `yaml:"rules,omitempty"`
+	} `yaml:"webhooks"`
+
+	Health struct {
+		Interval int `yaml:"interval,omitempty"`
+		Timeout int `yaml:"timeout,omitempty"`
+		MICommand string `yaml:"mi_command,omitempty"`
+		Event string `yaml:"event,omitempty"`
+		RefuseUnready bool `yaml:"refuse_unready,omitempty"`
+	} `yaml:"health"`
 }
 
 func printVersion(tool string) {
@@ -22,18 +22,48 @@ import (
 	"net"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/OpenSIPS/call-api/pkg/metrics"
 	"github.com/OpenSIPS/call-api/pkg/mi"
 	"github.com/OpenSIPS/call-api/internal/jsonrpc"
 )
 
-// DatagramSubscription - object referenced by Event users
+// how long (in seconds) a subscription lasts in the proxy before being renewed
+const subscribe_expire int = 120
+
+// how often a subscription is renewed - well before it expires
+var subscribe_refresh = time.Duration(subscribe_expire / 2) * time.Second
+
+// how many events can wait for a subscription still handling a previous one
+const subscription_backlog int = 256
+
+var (
+	eventsReceived = metrics.NewCounterVec("call_api_event_notifications_total",
+		"Number of event notifications received from the proxy, by event name.", "event")
+	eventsDropped = metrics.NewCounterVec("call_api_event_notifications_dropped_total",
+		"Number of event notifications that could not be delivered to any subscriber, by reason.", "reason")
+	activeSubscriptions = metrics.NewGauge("call_api_event_subscriptions",
+		"Number of active event subscriptions.")
+)
+
+// DatagramSubscription - object referenced by Event users; its events are
+// handled one at a time, in the order they were received
 type DatagramSubscription struct {
 	valid bool
 	notify EventNotification
 	filter map[string]interface{}
 	handler *EventDatagramSub
+	queue chan *jsonrpc.JsonRPCNotification
+}
+
+func (sub *DatagramSubscription) dispatch() {
+	for n := range sub.queue {
+		if sub.valid {
+			sub.notify(sub, n)
+		}
+	}
 }
 
 func (sub *DatagramSubscription) Event() (string) {
@@ -67,6 +97,7 @@ type EventDatagramSub struct {
 	event string
 	subscribed bool
 	confirm chan error
+	stop chan struct{}
 	lock sync.RWMutex
 	handler *EventDatagram
 	subscriptions []*DatagramSubscription
@@ -96,10 +127,13 @@ func (sub *EventDatagramSub) newSubscription(notify EventNotification, filter ma
 		filter: filter,
 		handler: sub,
 		valid: true,
+		queue: make(chan *jsonrpc.JsonRPCNotification, subscription_backlog),
 	}
+	go ds.dispatch()
 	sub.lock.Lock()
 	sub.subscriptions = append(sub.subscriptions, ds)
 	sub.lock.Unlock()
+	activeSubscriptions.Inc()
 	return ds
 }
 
@@ -108,6 +142,9 @@ func (sub *EventDatagramSub) removeSubscription(ds *DatagramSubscription) {
 	for i, s := range sub.subscriptions {
 		if s == ds {
 			sub.subscriptions = append(sub.subscriptions[0:i], sub.subscriptions[i+1:]...)
+			/* events are only queued under lock, so none can follow */
+			close(ds.queue)
+			activeSubscriptions.Dec()
 			break
 		}
 	}
@@ -132,11 +169,43 @@ func (sub *EventDatagramSub) removeSubscription(ds *DatagramSubscription) {
 	}
 }
 
+// keeps the subscription alive in the proxy, until there are no more users
+func (sub *EventDatagramSub) refresh() {
+	ticker := time.NewTicker(subscribe_refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sub.stop:
+			return
+		case <-ticker.C:
+			var eviParams = map[string]interface{}{
+				"event": sub.event,
+				"socket": sub.handler.String(),
+				"expire": subscribe_expire,
+			}
+			/* the last user might have just left - do not subscribe again
+			 * after it unsubscribed */
+			sub.lock.RLock()
+			if len(sub.subscriptions) == 0 {
+				sub.lock.RUnlock()
+				return
+			}
+			err := sub.handler.mi.Call("event_subscribe", &eviParams, nil)
+			sub.lock.RUnlock()
+			if err != nil {
+				logrus.Error("could not refresh subscription for event " + sub.event + " " + err.Error())
+			}
+		}
+	}
+}
+
 func (sub *EventDatagramSub) subscribeReply(response *jsonrpc.JsonRPCResponse) {
 
 	if !response.IsError() {
 		// confirm the event is properly subscribed
 		sub.subscribed = true
+		go sub.refresh()
 	} else {
 		// wake up the event loop to inform there's no one in there
 		sub.lock.Lock()
@@ -149,13 +218,23 @@ func (sub *EventDatagramSub) subscribeReply(response *jsonrpc.JsonRPCResponse) {
 }
 
 func (sub *EventDatagramSub) notify(n *jsonrpc.JsonRPCNotification) {
+	delivered := false
 	sub.lock.RLock()
 	for _, s := range sub.subscriptions {
 		if s.valid && s.MatchFilter(n) {
-			go s.notify(s, n)
+			/* never block the other subscriptions on a slow one */
+			select {
+			case s.queue <- n:
+				delivered = true
+			default:
+				eventsDropped.Inc("overflow")
+			}
 		}
 	}
 	sub.lock.RUnlock()
+	if !delivered {
+		eventsDropped.Inc("unmatched")
+	}
 }
 
 // EventDatagram - handler of the Datagram connection
@@ -178,11 +257,16 @@ func (event *EventDatagram) waitForEvents() {
 			err = result.Parse(buffer[0:r])
 			if err != nil {
 				logrus.Error("could not parse notification: " + err.Error())
+				eventsDropped.Inc("unparsable")
 			} else {
+				eventsReceived.Inc(result.Method)
+				result.Received = time.Now()
 				sub = event.getEventSubscription(result.Method)
-				// run in a different routine to avoid blocking
+				// queued to each subscription, to avoid blocking
 				if sub != nil {
 					sub.notify(result)
+				} else {
+					eventsDropped.Inc("unroutable")
 				}
 			}
 		} else {
@@ -208,6 +292,7 @@ func (event *EventDatagram) newEventSubscription(ev string) (*EventDatagramSub)
 		event: ev,
 		handler: event,
 		confirm: make(chan error, 1),
+		stop: make(chan struct{}),
 		subscriptions: make([]*DatagramSubscription, 0),
 	}
 }
@@ -218,6 +303,7 @@ func (event *EventDatagram) removeEventSubscription(evSub *EventDatagramSub) {
 		if evSub == s {
 			logrus.Info("removing event " + evSub.String())
 			event.subs = append(event.subs[0:i], event.subs[i+1:]...)
+			close(evSub.stop)
 			break;
 		}
 	}
@@ -286,7 +372,7 @@ func (event *EventDatagram) SubscribeFilter(ev string, notify EventNotification,
 		var eviParams = map[string]interface{}{
 			"event": ev,
 			"socket": event.String(),
-			"expire": 120,
+			"expire": subscribe_expire,
 		}
 		err := event.mi.Call("event_subscribe", &eviParams, evSub.subscribeReply)
 		if err != nil {
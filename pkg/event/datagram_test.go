@@ -0,0 +1,182 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package event
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenSIPS/call-api/pkg/mi"
+	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+)
+
+// fakeMI - records the event_subscribe requests, and accepts all of them
+type fakeMI struct {
+	lock sync.Mutex
+	expires []int
+}
+
+func (f *fakeMI) Addr() (net.Addr) {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (f *fakeMI) Connect(url string) (error) {
+	return nil
+}
+
+func (f *fakeMI) SetTimeout(timeout time.Duration) {
+}
+
+func (f *fakeMI) Call(command string, params interface{}, fn mi.MIreply) (error) {
+	if command == "event_subscribe" {
+		p := *params.(*map[string]interface{})
+		f.lock.Lock()
+		f.expires = append(f.expires, p["expire"].(int))
+		f.lock.Unlock()
+	}
+	if fn != nil {
+		go fn(&jsonrpc.JsonRPCResponse{Result: "OK"})
+	}
+	return nil
+}
+
+func (f *fakeMI) CallSync(command string, params interface{}) (*jsonrpc.JsonRPCResponse, error) {
+	f.Call(command, params, nil)
+	return &jsonrpc.JsonRPCResponse{Result: "OK"}, nil
+}
+
+func (f *fakeMI) calls() ([]int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]int(nil), f.expires...)
+}
+
+func newTestEvent(t *testing.T, f *fakeMI) (*EventDatagram) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &EventDatagram{
+		mi: f,
+		conn: conn,
+		subs: make([]*EventDatagramSub, 0, 1),
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	defer func(d time.Duration) { subscribe_refresh = d }(subscribe_refresh)
+	subscribe_refresh = 20 * time.Millisecond
+
+	if subscribe_refresh >= time.Duration(subscribe_expire) * time.Second {
+		t.Fatal("subscriptions are not refreshed before they expire")
+	}
+
+	f := &fakeMI{}
+	ev := newTestEvent(t, f)
+	sub := ev.Subscribe("E_TEST", func(Subscription, *jsonrpc.JsonRPCNotification) {})
+	if sub == nil {
+		t.Fatal("could not subscribe")
+	}
+	defer sub.Unsubscribe()
+
+	time.Sleep(subscribe_refresh * 5)
+	calls := f.calls()
+	if len(calls) < 3 {
+		t.Fatalf("got %d event_subscribe requests, expected at least 3", len(calls))
+	}
+	for _, expire := range calls {
+		if expire != subscribe_expire {
+			t.Errorf("subscribed with expire %d, expected %d", expire, subscribe_expire)
+		}
+	}
+}
+
+func TestRefreshStops(t *testing.T) {
+	defer func(d time.Duration) { subscribe_refresh = d }(subscribe_refresh)
+	subscribe_refresh = 20 * time.Millisecond
+
+	f := &fakeMI{}
+	ev := newTestEvent(t, f)
+	sub := ev.Subscribe("E_TEST", func(Subscription, *jsonrpc.JsonRPCNotification) {})
+	if sub == nil {
+		t.Fatal("could not subscribe")
+	}
+	time.Sleep(subscribe_refresh * 2)
+
+	/* the last user is gone - the subscription is dropped, and no longer
+	 * refreshed */
+	sub.Unsubscribe()
+	calls := len(f.calls())
+	if last := f.calls()[calls - 1]; last != 0 {
+		t.Errorf("last event_subscribe has expire %d, expected 0", last)
+	}
+	time.Sleep(subscribe_refresh * 5)
+	if after := len(f.calls()); after != calls {
+		t.Errorf("got %d event_subscribe requests after unsubscribing", after - calls)
+	}
+}
+
+func TestOrder(t *testing.T) {
+	f := &fakeMI{}
+	ev := newTestEvent(t, f)
+
+	var lock sync.Mutex
+	var got []float64
+	sub := ev.Subscribe("E_TEST", func(s Subscription, n *jsonrpc.JsonRPCNotification) {
+		seq, _ := n.Get("seq")
+		/* a slow handler must not let the next events overtake it */
+		time.Sleep(time.Millisecond)
+		lock.Lock()
+		got = append(got, seq.(float64))
+		lock.Unlock()
+	})
+	if sub == nil {
+		t.Fatal("could not subscribe")
+	}
+	defer sub.Unsubscribe()
+
+	const events = 50
+	for i := 0; i < events; i++ {
+		ev.getEventSubscription("E_TEST").notify(&jsonrpc.JsonRPCNotification{
+			Method: "E_TEST",
+			Params: map[string]interface{}{"seq": float64(i)},
+		})
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		lock.Lock()
+		n := len(got)
+		lock.Unlock()
+		if n == events {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d events, expected %d", n, events)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for i, seq := range got {
+		if seq != float64(i) {
+			t.Fatalf("got events %v out of order", got)
+		}
+	}
+}
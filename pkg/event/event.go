@@ -35,6 +35,7 @@ type Event interface {
 	Init(mi.MI) (error)
 	Subscribe(event string, notify EventNotification) (Subscription)
 	SubscribeFilter(event string, notify EventNotification, filter map[string]interface{}) (Subscription)
+	String() (string)
 }
 
 func EventHandler(mi mi.MI) (Event) {
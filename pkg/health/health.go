@@ -0,0 +1,235 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/OpenSIPS/call-api/pkg/config"
+	"github.com/OpenSIPS/call-api/pkg/proxy"
+)
+
+const default_interval int = 10
+const default_timeout int = 5
+const default_mi_command string = "uptime"
+const default_event string = "E_CALL_TRANSFER"
+
+// CheckResult - outcome of the last run of a readiness check
+type CheckResult struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Duration float64 `json:"duration_ms"`
+	Checked time.Time `json:"checked_at"`
+}
+
+func (r *CheckResult) IsOK() (bool) {
+	return r.Status == "ok"
+}
+
+type Checker struct {
+	cfg *config.Config
+	proxy *proxy.Proxy
+	interval, timeout time.Duration
+	miCommand, event string
+
+	lock sync.RWMutex
+	checks map[string]*CheckResult
+}
+
+func NewChecker(cfg *config.Config) (*Checker) {
+	c := &Checker{
+		cfg: cfg,
+		interval: time.Duration(default_interval) * time.Second,
+		timeout: time.Duration(default_timeout) * time.Second,
+		miCommand: default_mi_command,
+		event: default_event,
+		checks: make(map[string]*CheckResult),
+	}
+	if cfg.Health.Interval != 0 {
+		c.interval = time.Duration(cfg.Health.Interval) * time.Second
+	}
+	if cfg.Health.Timeout != 0 {
+		c.timeout = time.Duration(cfg.Health.Timeout) * time.Second
+	}
+	if cfg.Health.MICommand != "" {
+		c.miCommand = cfg.Health.MICommand
+	}
+	if cfg.Health.Event != "" {
+		c.event = cfg.Health.Event
+	}
+	return c
+}
+
+// Start - probes the proxy periodically, in the background
+func (c *Checker) Start() {
+	go func() {
+		for {
+			c.runChecks()
+			time.Sleep(c.interval)
+		}
+	}()
+}
+
+func (c *Checker) getProxy() (*proxy.Proxy, error) {
+	if c.proxy == nil {
+		c.proxy = proxy.NewProxy(c.cfg)
+		if c.proxy == nil {
+			return nil, errors.New("could not initialize SIP proxy")
+		}
+		c.proxy.SetMITimeout(c.timeout)
+	}
+	return c.proxy, nil
+}
+
+func (c *Checker) checkMI(p *proxy.Proxy) (string, error) {
+	response, err := p.MICallSync(c.miCommand, nil)
+	if err != nil {
+		return "", err
+	}
+	if response.IsError() {
+		return "", response.Error
+	}
+	return c.miCommand + " answered", nil
+}
+
+func (c *Checker) checkEventSocket(p *proxy.Proxy) (string, error) {
+	socket := p.EventSocket()
+	if socket == "" {
+		return "", errors.New("event socket is not bound")
+	}
+
+	var eviParams = map[string]interface{}{
+		"event": c.event,
+		"socket": socket,
+		"expire": int(c.interval.Seconds()) * 2,
+	}
+	response, err := p.MICallSync("event_subscribe", &eviParams)
+	if err != nil {
+		return "", err
+	}
+	if response.IsError() {
+		return "", response.Error
+	}
+
+	/* we are not interested in the events, so drop the subscription */
+	eviParams["expire"] = 0
+	p.MICall("event_subscribe", &eviParams, nil)
+	return c.event + " subscribed on " + socket, nil
+}
+
+func (c *Checker) runCheck(name string, p *proxy.Proxy, check func(*proxy.Proxy) (string, error)) {
+	var detail string
+	var err error
+
+	start := time.Now()
+	if p == nil {
+		err = errors.New("SIP proxy not available")
+	} else {
+		detail, err = check(p)
+	}
+	result := &CheckResult{
+		Status: "ok",
+		Detail: detail,
+		Duration: float64(time.Since(start)) / float64(time.Millisecond),
+		Checked: start,
+	}
+	if err != nil {
+		result.Status = "failed"
+		result.Detail = err.Error()
+		logrus.Warnf("readiness check %s failed: %s", name, err)
+	}
+
+	c.lock.Lock()
+	c.checks[name] = result
+	c.lock.Unlock()
+}
+
+func (c *Checker) runChecks() {
+	p, err := c.getProxy()
+	if err != nil {
+		logrus.Error(err)
+	}
+	c.runCheck("mi", p, c.checkMI)
+	c.runCheck("event_socket", p, c.checkEventSocket)
+}
+
+// Ready - whether all the checks have passed on their last run
+func (c *Checker) Ready() (bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if len(c.checks) == 0 {
+		return false
+	}
+	for _, result := range c.checks {
+		if !result.IsOK() {
+			return false
+		}
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	message, err := json.Marshal(body)
+	if err != nil {
+		logrus.Error("failed to build JSON health status")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(message)
+}
+
+// Healthz - liveness of the API itself, does not depend on the proxy
+func (c *Checker) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "ok",
+	})
+}
+
+// Readyz - readiness of the API, along with the details of each check
+func (c *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	var status string
+	var code int
+
+	if c.Ready() {
+		status = "ready"
+		code = http.StatusOK
+	} else {
+		status = "not ready"
+		code = http.StatusServiceUnavailable
+	}
+
+	c.lock.RLock()
+	checks := make(map[string]CheckResult, len(c.checks))
+	for name, result := range c.checks {
+		checks[name] = *result
+	}
+	c.lock.RUnlock()
+
+	writeJSON(w, code, map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
@@ -0,0 +1,285 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric - a family of samples that can be exposed in the Prometheus text format
+type metric interface {
+	name() (string)
+	write(w *bufio.Writer)
+}
+
+type registry struct {
+	lock sync.Mutex
+	metrics []metric
+}
+
+var defaultRegistry = &registry{}
+
+func (r *registry) register(m metric) {
+	r.lock.Lock()
+	r.metrics = append(r.metrics, m)
+	r.lock.Unlock()
+}
+
+// DefaultBuckets - latency buckets (in seconds) used when none are provided
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// Handler - exposes all the registered metrics in the Prometheus text format
+func Handler() (http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defaultRegistry.lock.Lock()
+		metrics := make([]metric, len(defaultRegistry.metrics))
+		copy(metrics, defaultRegistry.metrics)
+		defaultRegistry.lock.Unlock()
+
+		sort.Slice(metrics, func(i, j int) bool {
+			return metrics[i].name() < metrics[j].name()
+		})
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		for _, m := range metrics {
+			m.write(bw)
+		}
+		bw.Flush()
+	})
+}
+
+// desc - common properties of all the metrics
+type desc struct {
+	fqname string
+	help string
+	kind string
+	labels []string
+}
+
+func (d *desc) name() (string) {
+	return d.fqname
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.fqname, d.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.fqname, d.kind)
+}
+
+func (d *desc) key(values []string) (string) {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d",
+			d.fqname, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+/* the text format only escapes these in label values - anything else,
+ * including UTF-8, is written as is */
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func quoteLabel(value string) (string) {
+	return "\"" + labelEscaper.Replace(value) + "\""
+}
+
+func formatLabels(names []string, values []string, extra ...string) (string) {
+	var pairs []string
+
+	for i, n := range names {
+		pairs = append(pairs, n + "=" + quoteLabel(values[i]))
+	}
+	for i := 0; i + 1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i] + "=" + quoteLabel(extra[i + 1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) (string) {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// CounterVec - monotonic counters, partitioned by a set of labels
+type CounterVec struct {
+	desc
+	lock sync.Mutex
+	values map[string]float64
+	labelValues map[string][]string
+}
+
+func NewCounterVec(name, help string, labels ...string) (*CounterVec) {
+	c := &CounterVec{
+		desc: desc{fqname: name, help: help, kind: "counter", labels: labels},
+		values: make(map[string]float64),
+		labelValues: make(map[string][]string),
+	}
+	defaultRegistry.register(c)
+	return c
+}
+
+func (c *CounterVec) Add(v float64, values ...string) {
+	key := c.key(values)
+	c.lock.Lock()
+	if _, ok := c.labelValues[key]; !ok {
+		c.labelValues[key] = values
+	}
+	c.values[key] += v
+	c.lock.Unlock()
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.lock.Lock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.fqname,
+			formatLabels(c.labels, c.labelValues[k]), formatFloat(c.values[k]))
+	}
+	c.lock.Unlock()
+}
+
+// Gauge - a single value that can go up and down
+type Gauge struct {
+	desc
+	lock sync.Mutex
+	value float64
+}
+
+func NewGauge(name, help string) (*Gauge) {
+	g := &Gauge{
+		desc: desc{fqname: name, help: help, kind: "gauge"},
+	}
+	defaultRegistry.register(g)
+	return g
+}
+
+func (g *Gauge) Add(v float64) {
+	g.lock.Lock()
+	g.value += v
+	g.lock.Unlock()
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) Set(v float64) {
+	g.lock.Lock()
+	g.value = v
+	g.lock.Unlock()
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	g.lock.Lock()
+	fmt.Fprintf(w, "%s %s\n", g.fqname, formatFloat(g.value))
+	g.lock.Unlock()
+}
+
+type histogramSample struct {
+	labelValues []string
+	counts []uint64
+	count uint64
+	sum float64
+}
+
+// HistogramVec - distribution of observed values, partitioned by a set of labels
+type HistogramVec struct {
+	desc
+	lock sync.Mutex
+	buckets []float64
+	samples map[string]*histogramSample
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) (*HistogramVec) {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &HistogramVec{
+		desc: desc{fqname: name, help: help, kind: "histogram", labels: labels},
+		buckets: buckets,
+		samples: make(map[string]*histogramSample),
+	}
+	defaultRegistry.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	key := h.key(values)
+	h.lock.Lock()
+	s, ok := h.samples[key]
+	if !ok {
+		s = &histogramSample{
+			labelValues: values,
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.samples[key] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+	h.lock.Unlock()
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.lock.Lock()
+	keys := make([]string, 0, len(h.samples))
+	for k := range h.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.samples[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.fqname,
+				formatLabels(h.labels, s.labelValues, "le", formatFloat(b)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.fqname,
+			formatLabels(h.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.fqname,
+			formatLabels(h.labels, s.labelValues), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.fqname,
+			formatLabels(h.labels, s.labelValues), s.count)
+	}
+	h.lock.Unlock()
+}
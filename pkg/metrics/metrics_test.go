@@ -0,0 +1,45 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLabelEscaping(t *testing.T) {
+	c := NewCounterVec("call_api_test_escaping_total", "Test counter.", "value")
+	c.Inc("quote\" backslash\\ newline\n utf-8 ☎ é")
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+
+	expected := `call_api_test_escaping_total{value="quote\" backslash\\ newline\n utf-8 ☎ é"} 1`
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "call_api_test_escaping_total{") {
+			if line != expected {
+				t.Errorf("got %s, expected %s", line, expected)
+			}
+			return
+		}
+	}
+	t.Fatalf("sample not exposed:\n%s", body)
+}
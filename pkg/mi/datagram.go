@@ -23,7 +23,16 @@ import (
 	"sync"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+	"github.com/OpenSIPS/call-api/pkg/metrics"
+)
+
+var (
+	miLatency = metrics.NewHistogramVec("call_api_mi_request_duration_seconds",
+		"Latency of the MI requests sent to the proxy, by MI command.", nil, "command")
+	miErrors = metrics.NewCounterVec("call_api_mi_request_errors_total",
+		"Number of failed MI requests, by MI command.", "command")
 )
 
 type MIDatagram struct {
@@ -31,7 +40,21 @@ type MIDatagram struct {
 	buffer []byte
 	idLock sync.Mutex
 	id     uint64
-	done   chan error
+	timeout time.Duration
+
+	/* the requests waiting for a reply, by their id - the replies are read
+	 * by a single reader, which hands each of them to its request */
+	pendingLock sync.Mutex
+	pending map[uint64]*miPending
+}
+
+// miPending - a request sent, waiting for its reply
+type miPending struct {
+	command string
+	start time.Time
+	fn MIreply
+	done chan error
+	timer *time.Timer
 }
 
 func (mi *MIDatagram) Connect(url string) error {
@@ -48,7 +71,8 @@ func (mi *MIDatagram) Connect(url string) error {
 	conn.SetWriteBuffer(65535)
 	mi.buffer = make([]byte, 65535)
 	mi.conn = conn
-	mi.done = make(chan error, 1)
+	mi.pending = make(map[uint64]*miPending)
+	go mi.readReplies()
 	return nil
 }
 
@@ -56,43 +80,90 @@ func (mi *MIDatagram) Addr() (net.Addr) {
 	return mi.conn.RemoteAddr()
 }
 
-func (mi *MIDatagram) getReply(currentId uint64, fn MIreply) {
-
-	r, _,  err := mi.conn.ReadFrom(mi.buffer)
-	if err != nil {
-		mi.done <- err
-		return
-	}
+/* bounds the time we wait for a reply - 0 waits forever */
+func (mi *MIDatagram) SetTimeout(timeout time.Duration) {
+	mi.timeout = timeout
+}
 
-	reply := &jsonrpc.JsonRPCResponse{}
-	err = reply.Parse(mi.buffer[0:r])
-	if err != nil {
-		mi.done <- err
-		return
-	}
+/* takes a request out of the pending ones, if still there */
+func (mi *MIDatagram) popPending(id uint64) (*miPending) {
+	mi.pendingLock.Lock()
+	defer mi.pendingLock.Unlock()
 
-	replyId, ok := reply.ID.(float64)
+	p, ok := mi.pending[id]
 	if !ok {
-		mi.done <- errors.New("id type error")
-		return
+		return nil
 	}
-
-	if uint64(replyId) != currentId {
-		mi.done <- errors.New("id mismatch %d")
-		return
+	delete(mi.pending, id)
+	if p.timer != nil {
+		p.timer.Stop()
 	}
+	return p
+}
+
+func (p *miPending) fail(err error) {
+	miErrors.Inc(p.command)
+	p.done <- err
+}
 
-	if fn != nil {
-		fn(reply)
+func (p *miPending) complete(reply *jsonrpc.JsonRPCResponse) {
+	miLatency.Observe(time.Since(p.start).Seconds(), p.command)
+	if reply.IsError() {
+		miErrors.Inc(p.command)
+	}
+	if p.fn != nil {
+		p.fn(reply)
 	}
-	mi.done <- nil
+	p.done <- nil
 }
 
-func (mi *MIDatagram) Wait() (error) {
-	return <- mi.done
+/* reads all the replies, and dispatches them to their requests */
+func (mi *MIDatagram) readReplies() {
+
+	for {
+		r, _,  err := mi.conn.ReadFrom(mi.buffer)
+		if err != nil {
+			/* the connection is no longer usable - fail everything pending */
+			logrus.Errorf("could not read MI reply: %s", err)
+			mi.pendingLock.Lock()
+			pending := mi.pending
+			mi.pending = make(map[uint64]*miPending)
+			mi.pendingLock.Unlock()
+			for _, p := range pending {
+				if p.timer != nil {
+					p.timer.Stop()
+				}
+				p.fail(err)
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		reply := &jsonrpc.JsonRPCResponse{}
+		if err = reply.Parse(mi.buffer[0:r]); err != nil {
+			logrus.Errorf("could not parse MI reply: %s", err)
+			continue
+		}
+		replyId, ok := reply.ID.(float64)
+		if !ok {
+			logrus.Error("invalid MI reply id type")
+			continue
+		}
+
+		p := mi.popPending(uint64(replyId))
+		if p == nil {
+			/* a late reply of a request we have given up on */
+			logrus.Debugf("dropping MI reply with unknown id %d", uint64(replyId))
+			continue
+		}
+		/* the callbacks may issue MI requests themselves */
+		go p.complete(reply)
+	}
 }
 
-func (mi *MIDatagram) Call(command string, params interface{}, fn MIreply) (error) {
+func (mi *MIDatagram) call(command string, params interface{}, fn MIreply) (*miPending, error) {
 
 	mi.idLock.Lock()
 	currentId := mi.id
@@ -102,46 +173,60 @@ func (mi *MIDatagram) Call(command string, params interface{}, fn MIreply) (erro
 	js := jsonrpc.NewRequest(currentId, command, params)
 	jb, err := js.Buffer()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	/* make sure the channel is drained */
-	for len(mi.done) > 0 {
-		<-mi.done
+	p := &miPending{
+		command: command,
+		fn: fn,
+		done: make(chan error, 1),
 	}
+	/* registered before writing, so the reply cannot be missed */
+	mi.pendingLock.Lock()
+	mi.pending[currentId] = p
+	mi.pendingLock.Unlock()
+
 	/* writing the request */
-	mi.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	p.start = time.Now()
+	mi.conn.SetWriteDeadline(p.start.Add(time.Second))
 	_, err = mi.conn.Write(jb)
 	if err != nil {
-		return err
+		mi.popPending(currentId)
+		miErrors.Inc(command)
+		return nil, err
 	}
 
 	/* waiting for the reply */
-	go mi.getReply(currentId, fn)
-	return nil
-}
-
-type miDatagramSync struct {
-	reply chan *jsonrpc.JsonRPCResponse
+	if mi.timeout != 0 {
+		mi.pendingLock.Lock()
+		if _, ok := mi.pending[currentId]; ok {
+			p.timer = time.AfterFunc(mi.timeout, func() {
+				if mi.popPending(currentId) != nil {
+					p.fail(errors.New("timeout waiting for MI reply to " + command))
+				}
+			})
+		}
+		mi.pendingLock.Unlock()
+	}
+	return p, nil
 }
 
-func (mi *miDatagramSync) callSyncStore(response *jsonrpc.JsonRPCResponse) {
-
-	mi.reply <- response
+func (mi *MIDatagram) Call(command string, params interface{}, fn MIreply) (error) {
+	_, err := mi.call(command, params, fn)
+	return err
 }
 
-func (mi *MIDatagram) CallSync(command string, param interface{}) (*jsonrpc.JsonRPCResponse, error) {
-	dgramSync := &miDatagramSync{make(chan *jsonrpc.JsonRPCResponse, 1)}
+func (mi *MIDatagram) CallSync(command string, params interface{}) (*jsonrpc.JsonRPCResponse, error) {
+	var response *jsonrpc.JsonRPCResponse
 
-	err := mi.Call(command, param, dgramSync.callSyncStore);
+	p, err := mi.call(command, params, func(reply *jsonrpc.JsonRPCResponse) {
+		response = reply
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	err = mi.Wait()
-	if err != nil {
+	if err = <-p.done; err != nil {
 		return nil, err
 	}
-
-	return <- dgramSync.reply, nil
+	return response, nil
 }
@@ -19,6 +19,7 @@ package mi
 
 import (
 	"net"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/OpenSIPS/call-api/pkg/config"
@@ -32,7 +33,7 @@ const default_url string = "127.0.0.1:8080"
 type MI interface {
 	Addr() (net.Addr)
 	Connect(url string) (error)
-	Wait() (error)
+	SetTimeout(timeout time.Duration)
 	Call(command string, params interface{}, fn MIreply) (error)
 	CallSync(command string, params interface{}) (*jsonrpc.JsonRPCResponse, error)
 }
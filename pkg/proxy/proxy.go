@@ -18,6 +18,8 @@
 package proxy
 
 import (
+	"time"
+
 	"github.com/sirupsen/logrus"
 	"github.com/OpenSIPS/call-api/internal/jsonrpc"
 	"github.com/OpenSIPS/call-api/pkg/config"
@@ -25,6 +27,8 @@ import (
 	"github.com/OpenSIPS/call-api/pkg/mi"
 )
 
+const default_media_relay string = "rtpengine"
+
 type Proxy struct {
 	mi mi.MI
 	ev event.Event
@@ -54,6 +58,10 @@ func (proxy *Proxy) MICallSync(command string, params interface{}) (*jsonrpc.Jso
 	return proxy.mi.CallSync(command, params)
 }
 
+func (proxy *Proxy) SetMITimeout(timeout time.Duration) {
+	proxy.mi.SetTimeout(timeout)
+}
+
 func (proxy *Proxy) Subscribe(event string, notify event.EventNotification) (event.Subscription) {
 	return proxy.ev.SubscribeFilter(event, notify, nil)
 }
@@ -62,6 +70,30 @@ func (proxy *Proxy) SubscribeFilter(event string, notify event.EventNotification
 	return proxy.ev.SubscribeFilter(event, notify, filter)
 }
 
+func (proxy *Proxy) EventSocket() (string) {
+	return proxy.ev.String()
+}
+
+func (proxy *Proxy) GetConfig() (*config.Config) {
+	return proxy.cfg
+}
+
 func (proxy *Proxy) GetURI() (string) {
 	return proxy.cfg.SIP.URI
 }
+
+// MediaRelay - the media relay module (rtpengine, rtpproxy) driven through MI
+func (proxy *Proxy) MediaRelay() (string) {
+	if proxy.cfg.Media.Relay != "" {
+		return proxy.cfg.Media.Relay
+	}
+	return default_media_relay
+}
+
+// MediaRecorder - the module (rtpengine, siprec) that records the calls
+func (proxy *Proxy) MediaRecorder() (string) {
+	if proxy.cfg.Media.Recording != "" {
+		return proxy.cfg.Media.Recording
+	}
+	return proxy.MediaRelay()
+}
@@ -0,0 +1,188 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package rest_server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/OpenSIPS/call-api/pkg/auth"
+	"github.com/OpenSIPS/call-api/pkg/cmd"
+	"github.com/OpenSIPS/call-api/pkg/config"
+	"github.com/OpenSIPS/call-api/pkg/proxy"
+)
+
+const commands_path string = "/commands/"
+
+// Gateway - runs commands over plain HTTP requests
+//
+//   POST /commands/{method} - starts a command, with the JSON body as params
+//   GET  /commands/{cmd_id} - returns the state and events of a command
+type Gateway struct {
+	cfg *config.Config
+	auth *auth.Authenticator
+	commands *cmd.Registry
+
+	lock sync.Mutex
+	/* shared by all the commands started over HTTP, just like a WebSocket
+	 * connection shares one among its commands - the MI replies are
+	 * matched to their requests by id, so concurrent commands are safe */
+	proxy *proxy.Proxy
+
+	feedsLock sync.Mutex
+	feeds map[string]*eventFeed // raw event subscriptions streamed over SSE
+}
+
+func NewGateway(cfg *config.Config, a *auth.Authenticator, commands *cmd.Registry) (*Gateway) {
+	return &Gateway{
+		cfg: cfg,
+		auth: a,
+		commands: commands,
+		feeds: make(map[string]*eventFeed),
+	}
+}
+
+func (gw *Gateway) getProxy() (*proxy.Proxy) {
+	gw.lock.Lock()
+	defer gw.lock.Unlock()
+
+	if gw.proxy == nil {
+		gw.proxy = proxy.NewProxy(gw.cfg)
+	}
+	return gw.proxy
+}
+
+func replyJSON(w http.ResponseWriter, code int, body interface{}) {
+	message, err := json.Marshal(body)
+	if err != nil {
+		logrus.Error("failed to build JSON reply")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(message)
+}
+
+func replyError(w http.ResponseWriter, code int, error_msg string) {
+	replyJSON(w, code, map[string]interface{}{
+		"error": error_msg,
+	})
+}
+
+func (gw *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	identity, err := gw.auth.Authenticate(r)
+	if err != nil {
+		replyError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, commands_path)
+	if name == "" || strings.Contains(name, "/") {
+		replyError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		gw.startCommand(w, r, identity, name)
+	case http.MethodGet:
+		gw.getCommand(w, identity, name)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		replyError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (gw *Gateway) startCommand(w http.ResponseWriter, r *http.Request, identity *auth.Identity, method string) {
+	var cmd_id string
+
+	if !identity.Allowed(method) {
+		replyError(w, http.StatusForbidden, "method not allowed")
+		return
+	}
+
+	params := make(map[string]interface{})
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		replyError(w, http.StatusBadRequest, "could not read request body")
+		return
+	}
+	if len(body) != 0 {
+		if err = json.Unmarshal(body, &params); err != nil {
+			replyError(w, http.StatusBadRequest, "non-object parameters are not accepted")
+			return
+		}
+	}
+
+	if cmd_any_id, ok := params["cmd_id"]; ok {
+		cmd_id, ok = cmd_any_id.(string)
+		if !ok {
+			replyError(w, http.StatusBadRequest, "bad cmd_id (must be a string)")
+			return
+		}
+	}
+
+	p := gw.getProxy()
+	if p == nil {
+		replyError(w, http.StatusServiceUnavailable, "could not initialize SIP proxy")
+		return
+	}
+
+	c := cmd.New(method, cmd_id, p)
+	if c == nil {
+		replyError(w, http.StatusNotFound, "unknown method")
+		return
+	}
+
+	if err = gw.commands.Track(c, identity.Name, params, nil); err != nil {
+		if errors.Is(err, cmd.ErrCallbackURL) {
+			replyError(w, http.StatusBadRequest, err.Error())
+		} else {
+			replyError(w, http.StatusConflict, err.Error())
+		}
+		return
+	}
+
+	if err = c.Run(params); err != nil {
+		replyError(w, http.StatusBadRequest, "bad parameters")
+		return
+	}
+
+	logrus.Infof("started cmd %s (%s) over HTTP", c.Command, c.ID)
+	replyJSON(w, http.StatusAccepted, map[string]interface{}{
+		"cmd_id": c.ID,
+		"event": "Started",
+	})
+}
+
+func (gw *Gateway) getCommand(w http.ResponseWriter, identity *auth.Identity, cmd_id string) {
+
+	rec := gw.commands.Get(cmd_id)
+	if rec == nil || !identity.Owns(rec.Identity) {
+		replyError(w, http.StatusNotFound, "unknown cmd_id")
+		return
+	}
+	replyJSON(w, http.StatusOK, rec)
+}
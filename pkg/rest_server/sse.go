@@ -0,0 +1,380 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package rest_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+	"github.com/OpenSIPS/call-api/pkg/auth"
+	"github.com/OpenSIPS/call-api/pkg/cmd"
+	"github.com/OpenSIPS/call-api/pkg/event"
+)
+
+// how often a comment is sent on idle streams, so proxies do not close them
+const keepalive_interval = 15 * time.Second
+
+// how many raw events are kept, so that clients can resume their streams
+const feed_backlog int = 256
+
+// how long a raw event subscription is kept after its last client left
+const feed_linger = 60 * time.Second
+
+type feedEvent struct {
+	seq uint64
+	notify *jsonrpc.JsonRPCNotification
+}
+
+// eventFeed - a raw event subscription, shared by all the streams of an event
+type eventFeed struct {
+	name string
+	sub event.Subscription
+	lock sync.Mutex
+	seq uint64
+	backlog []*feedEvent
+	clients map[chan *feedEvent]map[string]interface{}
+	linger *time.Timer
+	dropped bool
+}
+
+func matchFilter(notify *jsonrpc.JsonRPCNotification, filter map[string]interface{}) (bool) {
+	for k, v := range filter {
+		r, err := notify.Get(k)
+		if err != nil || fmt.Sprint(r) != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (feed *eventFeed) notify(sub event.Subscription, notify *jsonrpc.JsonRPCNotification) {
+	feed.lock.Lock()
+	defer feed.lock.Unlock()
+
+	feed.seq++
+	ev := &feedEvent{seq: feed.seq, notify: notify}
+	feed.backlog = append(feed.backlog, ev)
+	if len(feed.backlog) > feed_backlog {
+		feed.backlog = feed.backlog[1:]
+	}
+	for c, filter := range feed.clients {
+		if !matchFilter(notify, filter) {
+			continue
+		}
+		select {
+		case c <- ev:
+		default:
+			/* too slow - let it catch up by resuming from its last event */
+			delete(feed.clients, c)
+			close(c)
+		}
+	}
+}
+
+/* returns the feed of an event, subscribing for it if needed; the
+ * subscription might wait for the proxy, so it is not done under the feeds
+ * lock, that every stream needs */
+func (gw *Gateway) getFeed(name string) (*eventFeed, error) {
+	gw.feedsLock.Lock()
+	feed, ok := gw.feeds[name]
+	gw.feedsLock.Unlock()
+	if ok {
+		return feed, nil
+	}
+
+	feed = &eventFeed{
+		name: name,
+		clients: make(map[chan *feedEvent]map[string]interface{}),
+	}
+	p := gw.getProxy()
+	if p == nil {
+		return nil, fmt.Errorf("could not initialize SIP proxy")
+	}
+	sub := p.Subscribe(name, feed.notify)
+	if sub == nil {
+		return nil, fmt.Errorf("could not subscribe for event %s", name)
+	}
+
+	gw.feedsLock.Lock()
+	defer gw.feedsLock.Unlock()
+	if other, ok := gw.feeds[name]; ok {
+		/* another stream subscribed in the meantime - use its feed */
+		sub.Unsubscribe()
+		return other, nil
+	}
+	feed.lock.Lock()
+	feed.sub = sub
+	feed.lock.Unlock()
+	gw.feeds[name] = feed
+	return feed, nil
+}
+
+func (gw *Gateway) attachFeed(name string, since uint64, filter map[string]interface{}) (chan *feedEvent, error) {
+	var feed *eventFeed
+	var err error
+
+	for {
+		feed, err = gw.getFeed(name)
+		if err != nil {
+			return nil, err
+		}
+		feed.lock.Lock()
+		if !feed.dropped {
+			break
+		}
+		/* dropped after lingering, before we got to it - try again */
+		feed.lock.Unlock()
+	}
+	defer feed.lock.Unlock()
+
+	if feed.linger != nil {
+		feed.linger.Stop()
+		feed.linger = nil
+	}
+	c := make(chan *feedEvent, feed_backlog * 2)
+	if since != cmd.ListenLive {
+		for _, ev := range feed.backlog {
+			if ev.seq > since && matchFilter(ev.notify, filter) {
+				c <- ev
+			}
+		}
+	}
+	feed.clients[c] = filter
+	return c, nil
+}
+
+func (gw *Gateway) detachFeed(name string, c chan *feedEvent) {
+	gw.feedsLock.Lock()
+	feed, ok := gw.feeds[name]
+	gw.feedsLock.Unlock()
+	if !ok {
+		return
+	}
+
+	feed.lock.Lock()
+	defer feed.lock.Unlock()
+
+	if _, ok := feed.clients[c]; ok {
+		delete(feed.clients, c)
+		close(c)
+	}
+	if len(feed.clients) != 0 || feed.linger != nil {
+		return
+	}
+	feed.linger = time.AfterFunc(feed_linger, func() {
+		gw.feedsLock.Lock()
+		defer gw.feedsLock.Unlock()
+		feed.lock.Lock()
+		defer feed.lock.Unlock()
+
+		if len(feed.clients) != 0 || gw.feeds[name] != feed {
+			return
+		}
+		delete(gw.feeds, name)
+		feed.dropped = true
+		feed.sub.Unsubscribe()
+		logrus.Debugf("dropped raw event stream for %s", name)
+	})
+}
+
+type sseWriter struct {
+	w http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (sse *sseWriter) send(id uint64, body interface{}) (error) {
+	message, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(sse.w, "id: %d\ndata: %s\n\n", id, message)
+	if err != nil {
+		return err
+	}
+	sse.flusher.Flush()
+	return nil
+}
+
+func (sse *sseWriter) keepalive() (error) {
+	_, err := fmt.Fprint(sse.w, ": keepalive\n\n")
+	if err != nil {
+		return err
+	}
+	sse.flusher.Flush()
+	return nil
+}
+
+// EventStream - streams notifications as Server-Sent Events:
+//
+//   GET /events?cmd_id={cmd_id} - the events of a single command
+//   GET /events                 - the events of all the identity's commands
+//   GET /events?event={event}   - raw proxy events; the rest of the query
+//                                 parameters are used to filter them
+func (gw *Gateway) EventStream(w http.ResponseWriter, r *http.Request) {
+
+	identity, err := gw.auth.Authenticate(r)
+	if err != nil {
+		replyError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		replyError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		replyError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	var since uint64 = cmd.ListenLive
+	if last := r.Header.Get("Last-Event-ID"); last != "" {
+		since, err = strconv.ParseUint(last, 10, 64)
+		if err != nil {
+			replyError(w, http.StatusBadRequest, "bad Last-Event-ID")
+			return
+		}
+	}
+
+	sse := &sseWriter{w: w, flusher: flusher}
+	query := r.URL.Query()
+	if name := query.Get("event"); name != "" {
+		gw.streamFeed(sse, r, identity, name, since)
+	} else {
+		gw.streamCommands(sse, r, identity, query.Get("cmd_id"), since)
+	}
+}
+
+func startStream(sse *sseWriter) {
+	sse.w.Header().Set("Content-Type", "text/event-stream")
+	sse.w.Header().Set("Cache-Control", "no-cache")
+	sse.w.Header().Set("Connection", "keep-alive")
+	sse.w.Header().Set("X-Accel-Buffering", "no")
+	sse.w.WriteHeader(http.StatusOK)
+	sse.flusher.Flush()
+}
+
+func (gw *Gateway) streamCommands(sse *sseWriter, r *http.Request, identity *auth.Identity, cmd_id string, since uint64) {
+	var filter cmd.ListenFilter
+
+	if cmd_id != "" {
+		rec := gw.commands.Get(cmd_id)
+		if rec == nil || !identity.Owns(rec.Identity) {
+			replyError(sse.w, http.StatusNotFound, "unknown cmd_id")
+			return
+		}
+		if since == cmd.ListenLive {
+			/* a new client of a command gets all its history */
+			since = 0
+		}
+		/* the client already got the final event - there is nothing left
+		 * to stream, and 204 tells it not to reconnect */
+		if rec.Ended != nil && (len(rec.Events) == 0 ||
+				rec.Events[len(rec.Events) - 1].Seq <= since) {
+			sse.w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		filter = func(n *cmd.Notification) (bool) {
+			return n.ID == cmd_id
+		}
+	} else {
+		filter = func(n *cmd.Notification) (bool) {
+			return identity.Owns(n.Identity)
+		}
+	}
+
+	l := gw.commands.Listen(since, filter)
+	defer l.Close()
+
+	startStream(sse)
+	ticker := time.NewTicker(keepalive_interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if sse.keepalive() != nil {
+				return
+			}
+		case n, ok := <-l.C:
+			if !ok {
+				return
+			}
+			if sse.send(n.Seq, n.JsonRPC()) != nil {
+				return
+			}
+			if cmd_id != "" && n.Event == "Ended" {
+				return
+			}
+		}
+	}
+}
+
+func (gw *Gateway) streamFeed(sse *sseWriter, r *http.Request, identity *auth.Identity, name string, since uint64) {
+
+	if !identity.AllowedEvent(name) {
+		replyError(sse.w, http.StatusForbidden, "event not allowed")
+		return
+	}
+
+	filter := make(map[string]interface{})
+	for k, v := range r.URL.Query() {
+		if k != "event" && k != "token" && len(v) != 0 {
+			filter[k] = v[0]
+		}
+	}
+
+	c, err := gw.attachFeed(name, since, filter)
+	if err != nil {
+		replyError(sse.w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	defer gw.detachFeed(name, c)
+
+	startStream(sse)
+	ticker := time.NewTicker(keepalive_interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if sse.keepalive() != nil {
+				return
+			}
+		case ev, ok := <-c:
+			if !ok {
+				return
+			}
+			if sse.send(ev.seq, ev.notify) != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,422 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/OpenSIPS/call-api/pkg/cmd"
+	"github.com/OpenSIPS/call-api/pkg/config"
+	"github.com/OpenSIPS/call-api/pkg/metrics"
+)
+
+const default_timeout int = 5
+const default_retries int = 5
+const default_backoff int = 1
+const default_max_backoff int = 60
+const default_concurrency int = 4
+
+/* how many webhooks can wait for a worker of an endpoint */
+const queue_size int = 1024
+
+/* how long the workers of an endpoint are kept without any webhook */
+const endpoint_idle time.Duration = 5 * time.Minute
+
+var (
+	webhooksSent = metrics.NewCounterVec("call_api_webhooks_total",
+		"Number of webhooks sent, by outcome.", "outcome")
+)
+
+// Payload - the JSON body POSTed for each event
+type Payload struct {
+	Seq uint64 `json:"seq"`
+	Time time.Time `json:"time"`
+	ID string `json:"cmd_id"`
+	Command string `json:"method"`
+	Identity string `json:"identity,omitempty"`
+	Event string `json:"event"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+type rule struct {
+	url string
+	methods map[string]bool
+	events map[string]bool
+}
+
+func (r *rule) match(n *cmd.Notification) (bool) {
+	if len(r.methods) != 0 && !r.methods[n.Command] {
+		return false
+	}
+	if len(r.events) != 0 && !r.events[n.Event] {
+		return false
+	}
+	return true
+}
+
+// delivery - a webhook waiting to be posted
+type delivery struct {
+	n *cmd.Notification
+	body []byte
+}
+
+// endpoint - the workers posting the webhooks of an URL; the webhooks of a
+// command are always posted by the same worker, one after the other, so
+// they arrive in order
+type endpoint struct {
+	url string
+	queues []chan *delivery
+	used time.Time
+}
+
+type Dispatcher struct {
+	secret []byte
+	timeout time.Duration
+	retries int
+	backoff, maxBackoff time.Duration
+	concurrency int
+	rules []*rule
+	allowedHosts map[string]bool
+	client *http.Client
+
+	lock sync.Mutex
+	endpoints map[string]*endpoint
+	idle time.Duration
+
+	deadLock sync.Mutex
+	deadLetter io.Writer
+}
+
+func NewDispatcher(cfg *config.Config) (*Dispatcher) {
+	d := &Dispatcher{
+		secret: []byte(cfg.Webhooks.Secret),
+		timeout: time.Duration(default_timeout) * time.Second,
+		retries: default_retries,
+		backoff: time.Duration(default_backoff) * time.Second,
+		maxBackoff: time.Duration(default_max_backoff) * time.Second,
+		concurrency: default_concurrency,
+		allowedHosts: make(map[string]bool),
+		endpoints: make(map[string]*endpoint),
+		idle: endpoint_idle,
+	}
+	if cfg.Webhooks.Timeout != 0 {
+		d.timeout = time.Duration(cfg.Webhooks.Timeout) * time.Second
+	}
+	/* 0 disables the retries */
+	if cfg.Webhooks.Retries != nil && *cfg.Webhooks.Retries >= 0 {
+		d.retries = *cfg.Webhooks.Retries
+	}
+	if cfg.Webhooks.Backoff != 0 {
+		d.backoff = time.Duration(cfg.Webhooks.Backoff) * time.Second
+	}
+	if cfg.Webhooks.MaxBackoff != 0 {
+		d.maxBackoff = time.Duration(cfg.Webhooks.MaxBackoff) * time.Second
+	}
+	if cfg.Webhooks.Concurrency != 0 {
+		d.concurrency = cfg.Webhooks.Concurrency
+	}
+	d.client = &http.Client{Timeout: d.timeout}
+
+	for _, host := range cfg.Webhooks.AllowedHosts {
+		d.allowedHosts[strings.ToLower(host)] = true
+	}
+
+	for _, r := range cfg.Webhooks.Rules {
+		wr := &rule{
+			url: r.URL,
+			methods: make(map[string]bool),
+			events: make(map[string]bool),
+		}
+		for _, m := range r.Methods {
+			wr.methods[m] = true
+		}
+		for _, e := range r.Events {
+			wr.events[e] = true
+		}
+		d.rules = append(d.rules, wr)
+	}
+
+	if cfg.Webhooks.DeadLetter != "" {
+		f, err := os.OpenFile(cfg.Webhooks.DeadLetter, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			logrus.Errorf("could not open webhooks dead letter log: %s", err)
+		} else {
+			d.deadLetter = f
+		}
+	}
+	return d
+}
+
+// CheckCallback - checks that the callback_url of a command is an HTTP(S)
+// URL of one of the allowed hosts, so that the clients cannot make the API
+// post to any other host
+func (d *Dispatcher) CheckCallback(callback string) (error) {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return errors.New("malformed URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return errors.New("host not specified")
+	}
+	/* either the host, or the host and port, can be allowed */
+	if !d.allowedHosts[strings.ToLower(u.Host)] &&
+			!d.allowedHosts[strings.ToLower(u.Hostname())] {
+		return errors.New("host " + u.Host + " not allowed")
+	}
+	return nil
+}
+
+// Run - posts the events of all the commands in the registry, in background
+func (d *Dispatcher) Run(commands *cmd.Registry) {
+	commands.SetCallbackCheck(d.CheckCallback)
+
+	go func() {
+		ticker := time.NewTicker(d.idle)
+		for range ticker.C {
+			d.reap()
+		}
+	}()
+
+	go func() {
+		var last uint64 = cmd.ListenLive
+
+		for {
+			l := commands.Listen(last, func(n *cmd.Notification) (bool) {
+				return true
+			})
+			for n := range l.C {
+				d.Dispatch(n)
+				last = n.Seq
+			}
+			/* we've been dropped for being too slow - resume */
+			logrus.Warn("webhooks dispatcher fell behind, resuming")
+		}
+	}()
+}
+
+// Dispatch - posts an event to all the endpoints interested in it
+func (d *Dispatcher) Dispatch(n *cmd.Notification) {
+	var urls []string
+
+	if n.CallbackURL != "" {
+		urls = append(urls, n.CallbackURL)
+	}
+	for _, r := range d.rules {
+		if r.match(n) {
+			urls = append(urls, r.url)
+		}
+	}
+	if len(urls) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(&Payload{
+		Seq: n.Seq,
+		Time: n.Time,
+		ID: n.ID,
+		Command: n.Command,
+		Identity: n.Identity,
+		Event: n.Event,
+		Data: n.Data,
+	})
+	if err != nil {
+		logrus.Errorf("cmd %s (%s): failed to build webhook: %s", n.Command, n.ID, err)
+		return
+	}
+	for _, url := range urls {
+		d.enqueue(url, &delivery{n: n, body: body})
+	}
+}
+
+/* must be called with the dispatcher locked */
+func (d *Dispatcher) getEndpoint(url string) (*endpoint) {
+	ep, ok := d.endpoints[url]
+	if !ok {
+		ep = &endpoint{url: url}
+		for i := 0; i < d.concurrency; i++ {
+			queue := make(chan *delivery, queue_size)
+			ep.queues = append(ep.queues, queue)
+			go d.work(url, queue)
+		}
+		d.endpoints[url] = ep
+	}
+	ep.used = time.Now()
+	return ep
+}
+
+/* queues a webhook to the worker of its command; the queues are only written
+ * with the dispatcher locked, so that the reaper can safely close them */
+func (d *Dispatcher) enqueue(url string, dl *delivery) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.getEndpoint(url).enqueue(d, dl)
+}
+
+/* stops the workers of the endpoints that were not used lately, so that the
+ * endpoints of the callback URLs do not pile up */
+func (d *Dispatcher) reap() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for url, ep := range d.endpoints {
+		if time.Since(ep.used) < d.idle {
+			continue
+		}
+		/* the workers are done once they post what is still queued */
+		for _, queue := range ep.queues {
+			close(queue)
+		}
+		delete(d.endpoints, url)
+	}
+}
+
+/* picks the worker of a command, by hashing its id */
+func (ep *endpoint) enqueue(d *Dispatcher, dl *delivery) {
+	h := fnv.New32a()
+	h.Write([]byte(dl.n.ID))
+	select {
+	case ep.queues[h.Sum32() % uint32(len(ep.queues))] <- dl:
+	default:
+		webhooksSent.Inc("dead")
+		d.dead(ep.url, 0, errors.New("too many webhooks queued"), dl.body)
+	}
+}
+
+func (d *Dispatcher) work(url string, queue chan *delivery) {
+	for dl := range queue {
+		d.deliver(url, dl.n, dl.body)
+	}
+}
+
+// Sign - computes the signature of a webhook, sent in the
+// X-Call-API-Signature header as "sha256=<hex>"; the signed content is the
+// X-Call-API-Timestamp header, a dot, and the body
+func Sign(secret []byte, timestamp string, body []byte) (string) {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post - a single delivery attempt; returns whether it is worth retrying
+func (d *Dispatcher) post(url string, n *cmd.Notification, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "call-api")
+	req.Header.Set("X-Call-API-Event", n.Event)
+	req.Header.Set("X-Call-API-Delivery", strconv.FormatUint(n.Seq, 10))
+	req.Header.Set("X-Call-API-Timestamp", timestamp)
+	if len(d.secret) != 0 {
+		req.Header.Set("X-Call-API-Signature", Sign(d.secret, timestamp, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("endpoint replied %s", resp.Status)
+	default:
+		return false, fmt.Errorf("endpoint replied %s", resp.Status)
+	}
+}
+
+func (d *Dispatcher) deliver(url string, n *cmd.Notification, body []byte) {
+	var err error
+	var retry bool
+
+	backoff := d.backoff
+	attempt := 0
+	for {
+		attempt++
+		retry, err = d.post(url, n, body)
+
+		if err == nil {
+			webhooksSent.Inc("delivered")
+			logrus.Debugf("cmd %s (%s): posted %s to %s", n.Command, n.ID, n.Event, url)
+			return
+		}
+		if !retry || attempt > d.retries {
+			break
+		}
+		webhooksSent.Inc("retried")
+		logrus.Infof("cmd %s (%s): posting %s to %s failed (%s), retrying in %s",
+			n.Command, n.ID, n.Event, url, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > d.maxBackoff {
+			backoff = d.maxBackoff
+		}
+	}
+
+	webhooksSent.Inc("dead")
+	d.dead(url, attempt, err, body)
+}
+
+// dead - logs a webhook that could not be delivered
+func (d *Dispatcher) dead(url string, attempts int, err error, body []byte) {
+	logrus.Errorf("giving up posting webhook to %s after %d attempt(s): %s", url, attempts, err)
+	if d.deadLetter == nil {
+		return
+	}
+
+	line, jerr := json.Marshal(map[string]interface{}{
+		"time": time.Now(),
+		"url": url,
+		"attempts": attempts,
+		"error": err.Error(),
+		"payload": json.RawMessage(body),
+	})
+	if jerr != nil {
+		return
+	}
+	d.deadLock.Lock()
+	d.deadLetter.Write(append(line, '\n'))
+	d.deadLock.Unlock()
+}
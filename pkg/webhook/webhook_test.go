@@ -0,0 +1,351 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenSIPS/call-api/pkg/cmd"
+	"github.com/OpenSIPS/call-api/pkg/config"
+)
+
+/* a dead letter log that can be read while the workers write to it */
+type deadLog struct {
+	lock sync.Mutex
+	buf bytes.Buffer
+}
+
+func (dl *deadLog) Write(p []byte) (int, error) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	return dl.buf.Write(p)
+}
+
+func (dl *deadLog) lines() ([]map[string]interface{}) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+
+	var lines []map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(dl.buf.Bytes()), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal(line, &entry); err == nil {
+			lines = append(lines, entry)
+		}
+	}
+	return lines
+}
+
+// request - a webhook, as received by the test endpoint
+type request struct {
+	header http.Header
+	body []byte
+}
+
+// endpointServer - records the webhooks it gets, and answers them with the
+// statuses queued, then with 200
+type endpointServer struct {
+	*httptest.Server
+	lock sync.Mutex
+	statuses []int
+	requests []*request
+}
+
+func newEndpointServer(statuses ...int) (*endpointServer) {
+	es := &endpointServer{statuses: statuses}
+	es.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		es.lock.Lock()
+		es.requests = append(es.requests, &request{header: r.Header, body: body})
+		status := http.StatusOK
+		if len(es.statuses) != 0 {
+			status = es.statuses[0]
+			es.statuses = es.statuses[1:]
+		}
+		es.lock.Unlock()
+		w.WriteHeader(status)
+	}))
+	return es
+}
+
+func (es *endpointServer) received() ([]*request) {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	return append([]*request(nil), es.requests...)
+}
+
+func newTestDispatcher(cfg *config.Config) (*Dispatcher, *deadLog) {
+	d := NewDispatcher(cfg)
+	d.backoff = time.Millisecond
+	d.maxBackoff = 10 * time.Millisecond
+	dl := &deadLog{}
+	d.deadLetter = dl
+	return d, dl
+}
+
+func notification(id, command, event string, seq uint64, url string) (*cmd.Notification) {
+	return &cmd.Notification{
+		ID: id,
+		Command: command,
+		CallbackURL: url,
+		RecordEvent: &cmd.RecordEvent{
+			Seq: seq,
+			Time: time.Now(),
+			Event: event,
+			Data: map[string]interface{}{"callid": "test"},
+		},
+	}
+}
+
+/* waits for a condition to hold, for at most a second */
+func waitFor(t *testing.T, what string, cond func() (bool)) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSign(t *testing.T) {
+	es := newEndpointServer()
+	defer es.Close()
+
+	cfg := &config.Config{}
+	cfg.Webhooks.Secret = "secret"
+	d, _ := newTestDispatcher(cfg)
+	d.Dispatch(notification("1", "CallStart", "CallStarted", 1, es.URL))
+
+	waitFor(t, "the webhook", func() (bool) { return len(es.received()) == 1 })
+	req := es.received()[0]
+	timestamp := req.header.Get("X-Call-API-Timestamp")
+	if timestamp == "" {
+		t.Fatal("missing timestamp header")
+	}
+	expected := Sign([]byte("secret"), timestamp, req.body)
+	if got := req.header.Get("X-Call-API-Signature"); got != expected {
+		t.Errorf("signature %q, expected %q", got, expected)
+	}
+	if got := req.header.Get("X-Call-API-Event"); got != "CallStarted" {
+		t.Errorf("event header %q, expected CallStarted", got)
+	}
+
+	var payload Payload
+	if err := json.Unmarshal(req.body, &payload); err != nil {
+		t.Fatalf("invalid payload: %s", err)
+	}
+	if payload.ID != "1" || payload.Command != "CallStart" || payload.Event != "CallStarted" {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+}
+
+func TestUnsigned(t *testing.T) {
+	es := newEndpointServer()
+	defer es.Close()
+
+	d, _ := newTestDispatcher(&config.Config{})
+	d.Dispatch(notification("1", "CallStart", "CallStarted", 1, es.URL))
+
+	waitFor(t, "the webhook", func() (bool) { return len(es.received()) == 1 })
+	if got := es.received()[0].header.Get("X-Call-API-Signature"); got != "" {
+		t.Errorf("unexpected signature %q without a secret", got)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	es := newEndpointServer()
+	defer es.Close()
+
+	cfg := &config.Config{}
+	cfg.Webhooks.Rules = append(cfg.Webhooks.Rules, struct {
+		URL string `yaml:"url"`
+		Methods []string `yaml:"methods,omitempty"`
+		Events []string `yaml:"events,omitempty"`
+	}{
+		URL: es.URL,
+		Methods: []string{"CallStart"},
+		Events: []string{"CallAnswered"},
+	})
+	d, _ := newTestDispatcher(cfg)
+
+	d.Dispatch(notification("1", "CallStart", "CallStarted", 1, ""))
+	d.Dispatch(notification("2", "CallEnd", "CallAnswered", 2, ""))
+	d.Dispatch(notification("1", "CallStart", "CallAnswered", 3, ""))
+
+	waitFor(t, "the webhook", func() (bool) { return len(es.received()) >= 1 })
+	/* give the filtered out events a chance to show up */
+	time.Sleep(50 * time.Millisecond)
+	received := es.received()
+	if len(received) != 1 {
+		t.Fatalf("got %d webhooks, expected 1", len(received))
+	}
+	if got := received[0].header.Get("X-Call-API-Delivery"); got != "3" {
+		t.Errorf("delivered event %s, expected 3", got)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	es := newEndpointServer(http.StatusInternalServerError, http.StatusServiceUnavailable)
+	defer es.Close()
+
+	d, dl := newTestDispatcher(&config.Config{})
+	d.Dispatch(notification("1", "CallStart", "CallStarted", 1, es.URL))
+
+	waitFor(t, "the retries", func() (bool) { return len(es.received()) == 3 })
+	time.Sleep(50 * time.Millisecond)
+	if n := len(es.received()); n != 3 {
+		t.Errorf("got %d attempts, expected 3", n)
+	}
+	if lines := dl.lines(); len(lines) != 0 {
+		t.Errorf("delivered webhook was dead-lettered: %v", lines)
+	}
+}
+
+func TestNoRetries(t *testing.T) {
+	es := newEndpointServer(http.StatusInternalServerError)
+	defer es.Close()
+
+	retries := 0
+	cfg := &config.Config{}
+	cfg.Webhooks.Retries = &retries
+	d, dl := newTestDispatcher(cfg)
+	d.Dispatch(notification("1", "CallStart", "CallStarted", 1, es.URL))
+
+	waitFor(t, "the dead letter", func() (bool) { return len(dl.lines()) == 1 })
+	if n := len(es.received()); n != 1 {
+		t.Errorf("got %d attempts, expected 1", n)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	es := newEndpointServer(http.StatusInternalServerError, http.StatusInternalServerError,
+		http.StatusInternalServerError, http.StatusBadRequest)
+	defer es.Close()
+
+	retries := 2
+	cfg := &config.Config{}
+	cfg.Webhooks.Retries = &retries
+	d, dl := newTestDispatcher(cfg)
+
+	/* retried until giving up */
+	d.Dispatch(notification("1", "CallStart", "CallStarted", 1, es.URL))
+	waitFor(t, "the dead letter", func() (bool) { return len(dl.lines()) == 1 })
+	entry := dl.lines()[0]
+	if entry["url"] != es.URL {
+		t.Errorf("dead letter url %v, expected %s", entry["url"], es.URL)
+	}
+	if entry["attempts"] != float64(3) {
+		t.Errorf("dead letter attempts %v, expected 3", entry["attempts"])
+	}
+	payload, _ := entry["payload"].(map[string]interface{})
+	if payload["event"] != "CallStarted" {
+		t.Errorf("dead letter payload %v", entry["payload"])
+	}
+
+	/* a client error is not retried */
+	d.Dispatch(notification("1", "CallStart", "CallEnded", 2, es.URL))
+	waitFor(t, "the dead letter", func() (bool) { return len(dl.lines()) == 2 })
+	if entry := dl.lines()[1]; entry["attempts"] != float64(1) {
+		t.Errorf("dead letter attempts %v, expected 1", entry["attempts"])
+	}
+}
+
+func TestOrder(t *testing.T) {
+	es := newEndpointServer(http.StatusInternalServerError, http.StatusInternalServerError)
+	defer es.Close()
+
+	d, _ := newTestDispatcher(&config.Config{})
+	events := []string{"CallStarted", "CalleeAnswered", "CallEnded"}
+	for i, event := range events {
+		d.Dispatch(notification("1", "CallStart", event, uint64(i + 1), es.URL))
+	}
+
+	/* the first event is retried, and the others wait for it */
+	waitFor(t, "the webhooks", func() (bool) { return len(es.received()) == 5 })
+	var delivered []string
+	for _, req := range es.received()[2:] {
+		delivered = append(delivered, req.header.Get("X-Call-API-Event"))
+	}
+	for i, event := range events {
+		if delivered[i] != event {
+			t.Fatalf("delivered %v, expected %v", delivered, events)
+		}
+	}
+}
+
+func TestCheckCallback(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Webhooks.AllowedHosts = []string{"crm.example.com", "10.0.0.20:8080"}
+	d, _ := newTestDispatcher(cfg)
+
+	for callback, allowed := range map[string]bool{
+		"https://crm.example.com/call-api": true,
+		"http://CRM.example.com:8443/call-api": true,
+		"http://10.0.0.20:8080/hook": true,
+		"http://10.0.0.20/hook": false,
+		"http://10.0.0.20:9090/hook": false,
+		"http://169.254.169.254/latest/meta-data": false,
+		"ftp://crm.example.com/call-api": false,
+		"file:///etc/passwd": false,
+		"crm.example.com/call-api": false,
+		"http://%zz": false,
+	} {
+		if err := d.CheckCallback(callback); (err == nil) != allowed {
+			t.Errorf("%s: got %v, expected allowed=%v", callback, err, allowed)
+		}
+	}
+
+	/* nothing is allowed without an allow-list */
+	d, _ = newTestDispatcher(&config.Config{})
+	if err := d.CheckCallback("https://crm.example.com/call-api"); err == nil {
+		t.Error("callback allowed without any allowed host")
+	}
+}
+
+func TestReap(t *testing.T) {
+	es := newEndpointServer()
+	defer es.Close()
+
+	d, _ := newTestDispatcher(&config.Config{})
+	d.idle = 20 * time.Millisecond
+	d.Dispatch(notification("1", "CallStart", "CallStarted", 1, es.URL))
+	waitFor(t, "the webhook", func() (bool) { return len(es.received()) == 1 })
+
+	time.Sleep(2 * d.idle)
+	d.reap()
+	d.lock.Lock()
+	n := len(d.endpoints)
+	d.lock.Unlock()
+	if n != 0 {
+		t.Fatalf("%d idle endpoints left", n)
+	}
+
+	/* the endpoint comes back with the next webhook */
+	d.Dispatch(notification("1", "CallStart", "CallEnded", 2, es.URL))
+	waitFor(t, "the webhook", func() (bool) { return len(es.received()) == 2 })
+}
@@ -21,18 +21,30 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 	"github.com/OpenSIPS/call-api/internal/jsonrpc"
+	"github.com/OpenSIPS/call-api/pkg/auth"
 	"github.com/OpenSIPS/call-api/pkg/cmd"
 	"github.com/OpenSIPS/call-api/pkg/config"
+	"github.com/OpenSIPS/call-api/pkg/health"
+	"github.com/OpenSIPS/call-api/pkg/metrics"
 	"github.com/OpenSIPS/call-api/pkg/proxy"
+	"github.com/OpenSIPS/call-api/pkg/rest_server"
+	"github.com/OpenSIPS/call-api/pkg/webhook"
 )
 
 const default_ws_host string = "localhost"
 const default_ws_port int = 5059
 const default_ws_path string = "/call-api"
+const default_metrics_path string = "/metrics"
+const default_retention int = 300
+
+var activeConnections = metrics.NewGauge("call_api_ws_connections",
+	"Number of active WebSocket connections.")
 
 func IgnoreCheckOrigin(r *http.Request) bool {
 	return true;
@@ -42,15 +54,24 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: IgnoreCheckOrigin,
 }
 var Cfg *config.Config
+var Checker *health.Checker
+var Auth *auth.Authenticator
+var Commands *cmd.Registry
 
 type WSConnection struct {
 	conn *websocket.Conn
 	proxy *proxy.Proxy // two-way UDP connection to a SIP proxy
+	identity *auth.Identity
+	writeLock sync.Mutex // replies and notifications are written concurrently
 }
 
-type WSCmdEvent struct {
-	cmd *cmd.Cmd
-	event *cmd.CmdEvent
+func (wsc *WSConnection) write(message []byte) {
+	wsc.writeLock.Lock()
+	err := wsc.conn.WriteMessage(websocket.TextMessage, message)
+	wsc.writeLock.Unlock()
+	if err != nil {
+		logrus.Error("write: ", err)
+	}
 }
 
 func (wsc *WSConnection) ReplyError(error_msg string, jsonrpc_id interface{}) {
@@ -69,10 +90,7 @@ func (wsc *WSConnection) ReplyError(error_msg string, jsonrpc_id interface{}) {
 		return
 	}
 
-	err = wsc.conn.WriteMessage(websocket.TextMessage, message)
-	if err != nil {
-		logrus.Error("write: ", err)
-	}
+	wsc.write(message)
 }
 
 func (wsc *WSConnection) ReplyOK(jsonrpc_id interface{}, cmd_id string) {
@@ -91,62 +109,33 @@ func (wsc *WSConnection) ReplyOK(jsonrpc_id interface{}, cmd_id string) {
 		return
 	}
 
-	err = wsc.conn.WriteMessage(websocket.TextMessage, message)
-	if err != nil {
-		logrus.Error("write: ", err)
-	}
+	wsc.write(message)
 }
 
 // wait for random OpenSIPS MI events on a given WebSocket connection,
 // possibly from multiple Call Commands running concurrently, and forward them
-// to the WebSocket client as JSON-RPC Notifications
-func (wsc *WSConnection) pollWSConnection(agg chan *WSCmdEvent) {
-	var response *jsonrpc.JsonRPCNotification
-
-	for ev := range agg {
-		c := ev.cmd
-
-		if ev.event == nil {
-			response = jsonrpc.NewNotification(c.Command,
-				&map[string]interface{}{
-					"cmd_id": c.ID,
-					"event": "Ended",
-				},
-			)
-		} else {
-			logrus.Debugf("event on cmd %s (%s), event: %s", c.Command, c.ID, ev.event)
-
-			if ev.event.IsError() {
-				response = jsonrpc.NewNotification(c.Command,
-					&map[string]interface{}{
-						"cmd_id": c.ID,
-						"event": "Error",
-						"data": ev.event.Error.Error(),
-					},
-				)
-			} else {
-				body := map[string]interface{}{
-					"cmd_id": c.ID,
-					"event": ev.event.Name,
-				}
-				if ev.event.HasParams() {
-					body["data"] = ev.event.Params
-				}
-				response = jsonrpc.NewNotification(c.Command, body)
-			}
-		}
+// to the WebSocket client as JSON-RPC Notifications, until the connection
+// is done
+func (wsc *WSConnection) pollWSConnection(agg chan *cmd.Notification, done chan struct{}) {
 
-		message, err := json.Marshal(response)
-		if err != nil {
-			logrus.Errorf("cmd %s (%s): failed to build JSON notification: %s",
-						  c.Command, c.ID, ev.event)
+	for {
+		var n *cmd.Notification
+
+		select {
+		case n = <-agg:
+		case <-done:
 			return
 		}
+		logrus.Debugf("event on cmd %s (%s), event: %s", n.Command, n.ID, n.Event)
 
-		err = wsc.conn.WriteMessage(websocket.TextMessage, message)
+		message, err := json.Marshal(n.JsonRPC())
 		if err != nil {
-			logrus.Error("write: ", err)
+			logrus.Errorf("cmd %s (%s): failed to build JSON notification: %s",
+						  n.Command, n.ID, n.Event)
+			continue
 		}
+
+		wsc.write(message)
 	}
 }
 
@@ -157,7 +146,20 @@ func wsConnection(w http.ResponseWriter, r *http.Request) {
 
 	logrus.Debugf("new connection from %s", r.RemoteAddr)
 
-	wsc := &WSConnection{}
+	if Cfg.Health.RefuseUnready && !Checker.Ready() {
+		logrus.Warnf("refusing connection from %s: not ready", r.RemoteAddr)
+		http.Error(w, "service not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	identity, err := Auth.Authenticate(r)
+	if err != nil {
+		logrus.Warnf("refusing connection from %s: %s", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	wsc := &WSConnection{identity: identity}
 	wsc.conn, err = upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		logrus.Print("upgrade:", err)
@@ -165,6 +167,9 @@ func wsConnection(w http.ResponseWriter, r *http.Request) {
 	}
 	defer wsc.conn.Close()
 
+	activeConnections.Inc()
+	defer activeConnections.Dec()
+
 	logrus.Debug("upgraded to WebSocket")
 
 	wsc.proxy = proxy.NewProxy(Cfg)
@@ -172,9 +177,12 @@ func wsConnection(w http.ResponseWriter, r *http.Request) {
 		logrus.Fatal("could not initialize SIP proxy")
 	}
 
-	agg := make(chan *WSCmdEvent)
+	/* the commands of the connection might outlive it, so agg is never
+	 * closed - they stop forwarding their events once done is */
+	agg := make(chan *cmd.Notification)
+	done := make(chan struct{})
 
-	go wsc.pollWSConnection(agg)
+	go wsc.pollWSConnection(agg, done)
 
 	for {
 		_, message, err := wsc.conn.ReadMessage()
@@ -211,6 +219,11 @@ func wsConnection(w http.ResponseWriter, r *http.Request) {
 			cmd_id = ""
 		}
 
+		if !wsc.identity.Allowed(req.Method) {
+			wsc.ReplyError("JSON-RPC method not allowed", req.ID)
+			continue
+		}
+
 		c := cmd.New(req.Method, cmd_id, wsc.proxy)
 		if c == nil {
 			wsc.ReplyError("unknown JSON-RPC method", req.ID)
@@ -218,14 +231,16 @@ func wsConnection(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// we expect to receive at least a close on this command's channel
-		go func(c *cmd.Cmd) {
-			for event := range c.Wait() {
-				agg <- &WSCmdEvent{c, event}
+		err = Commands.Track(c, wsc.identity.Name, params, func(n *cmd.Notification) {
+			select {
+			case agg <- n:
+			case <-done:
 			}
-
-			logrus.Debugf("done reading events for cmd %s (%s)", c.Command, c.ID)
-			agg <- &WSCmdEvent{c, nil}
-		}(c)
+		})
+		if err != nil {
+			wsc.ReplyError(err.Error(), req.ID)
+			continue
+		}
 
 		// launch the Calling command to run asynchronously
 		err = c.Run(params)
@@ -238,12 +253,12 @@ func wsConnection(w http.ResponseWriter, r *http.Request) {
 		wsc.ReplyOK(req.ID, c.ID)
 	}
 
-	close(agg)
+	close(done)
 	logrus.Debugf("closed connection from %s", r.RemoteAddr)
 }
 
 func Run(cfg *config.Config) {
-	var host, path string
+	var host, path, metrics_path string
 	var port int
 	Cfg = cfg
 
@@ -265,7 +280,34 @@ func Run(cfg *config.Config) {
 		path = default_ws_path
 	}
 
+	if cfg.WSServer.MetricsPath != "" {
+		metrics_path = cfg.WSServer.MetricsPath
+	} else {
+		metrics_path = default_metrics_path
+	}
+
+	Checker = health.NewChecker(cfg)
+	Checker.Start()
+
+	Auth = auth.NewAuthenticator(cfg)
+	if cfg.Commands.Retention != 0 {
+		Commands = cmd.NewRegistry(time.Duration(cfg.Commands.Retention) * time.Second)
+	} else {
+		Commands = cmd.NewRegistry(time.Duration(default_retention) * time.Second)
+	}
+	webhook.NewDispatcher(cfg).Run(Commands)
+
+	scheduler := cmd.NewScheduler(cfg, Commands)
+	cmd.SetScheduler(scheduler)
+	scheduler.Start()
+
 	http.HandleFunc(path, wsConnection)
+	http.Handle(metrics_path, metrics.Handler())
+	http.HandleFunc("/healthz", Checker.Healthz)
+	http.HandleFunc("/readyz", Checker.Readyz)
+	gateway := rest_server.NewGateway(cfg, Auth, Commands)
+	http.Handle("/commands/", gateway)
+	http.HandleFunc("/events", gateway.EventStream)
 
 	listen := fmt.Sprintf("%s:%d", host, port)
 	logrus.Infof("Listening for JSON-RPC over WebSocket on %s%s ...", listen, path)
@@ -0,0 +1,190 @@
+//
+// Copyright (C) 2020 OpenSIPS Solutions
+//
+// Call API is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Call API is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+//
+
+package ws_server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/OpenSIPS/call-api/pkg/auth"
+	"github.com/OpenSIPS/call-api/pkg/cmd"
+	"github.com/OpenSIPS/call-api/pkg/config"
+)
+
+// fakeProxy - answers the MI requests of the API like OpenSIPS would, and
+// remembers where the events have to be sent
+type fakeProxy struct {
+	conn *net.UDPConn
+	lock sync.Mutex
+	sockets map[string]string /* event socket, by event */
+}
+
+func newFakeProxy(t *testing.T) (*fakeProxy) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := &fakeProxy{conn: conn, sockets: make(map[string]string)}
+	go fp.serve()
+	return fp
+}
+
+func (fp *fakeProxy) serve() {
+	buffer := make([]byte, 65535)
+	for {
+		n, addr, err := fp.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		var req struct {
+			ID interface{} `json:"id"`
+			Method string `json:"method"`
+			Params map[string]interface{} `json:"params"`
+		}
+		if json.Unmarshal(buffer[:n], &req) != nil {
+			continue
+		}
+		var result interface{} = "OK"
+		switch req.Method {
+		case "event_subscribe":
+			if expire, _ := req.Params["expire"].(float64); expire != 0 {
+				event, _ := req.Params["event"].(string)
+				socket, _ := req.Params["socket"].(string)
+				fp.lock.Lock()
+				fp.sockets[event] = strings.TrimPrefix(socket, "udp:")
+				fp.lock.Unlock()
+			}
+		case "dlg_list":
+			result = map[string]interface{}{
+				"Dialogs": []interface{}{
+					map[string]interface{}{"callid": req.Params["callid"]},
+				},
+			}
+		}
+		reply, _ := json.Marshal(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id": req.ID,
+			"result": result,
+		})
+		fp.conn.WriteToUDP(reply, addr)
+	}
+}
+
+/* raises an event towards the API */
+func (fp *fakeProxy) raise(t *testing.T, event string, params map[string]interface{}) {
+	fp.lock.Lock()
+	socket := fp.sockets[event]
+	fp.lock.Unlock()
+	if socket == "" {
+		t.Fatalf("nobody subscribed for %s", event)
+	}
+	addr, err := net.ResolveUDPAddr("udp", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method": event,
+		"params": params,
+	})
+	if _, err := fp.conn.WriteToUDP(message, addr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/* waits for a condition to hold, for at most a second */
+func waitFor(t *testing.T, what string, cond func() (bool)) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func hasEvent(rec *cmd.Record, name string) (bool) {
+	if rec == nil {
+		return false
+	}
+	for _, ev := range rec.Events {
+		if ev.Event == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDisconnectWithRunningCommand(t *testing.T) {
+	fp := newFakeProxy(t)
+	defer fp.conn.Close()
+
+	Cfg = &config.Config{}
+	Cfg.MI.URL = fp.conn.LocalAddr().String()
+	Auth = auth.NewAuthenticator(Cfg)
+	Commands = cmd.NewRegistry(time.Minute)
+
+	server := httptest.NewServer(http.HandlerFunc(wsConnection))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws" + strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.WriteJSON(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id": 1,
+		"method": "CallWatchDTMF",
+		"params": map[string]interface{}{"callid": "call-1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply struct {
+		Result map[string]string `json:"result"`
+	}
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatal(err)
+	}
+	cmd_id := reply.Result["cmd_id"]
+	if cmd_id == "" {
+		t.Fatal("command not started")
+	}
+	waitFor(t, "the watch", func() (bool) {
+		return hasEvent(Commands.Get(cmd_id), "DTMFWatching")
+	})
+
+	/* the command outlives the connection, and keeps getting events */
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	fp.raise(t, "E_CALL_DTMF", map[string]interface{}{
+		"callid": "call-1",
+		"leg": "caller",
+		"digit": "5",
+	})
+	waitFor(t, "the digit", func() (bool) {
+		return hasEvent(Commands.Get(cmd_id), "DTMFReceived")
+	})
+}